@@ -0,0 +1,365 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/unicode/norm"
+)
+
+func init() {
+	settingDefaults["filter.blocklist.enabled"] = "true"
+	settingDefaults["filter.blocklist.exempt"] = "none"
+	settingValidators["filter.blocklist.exempt"] = validRole
+	messageFilters = append(messageFilters, blocklistFilter)
+}
+
+// homoglyphs folds look-alike letters from other scripts onto their Latin twins.
+var homoglyphs = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'ɡ': 'g', 'ӏ': 'l', 'ı': 'i', 'ʟ': 'l', 'ɴ': 'n', 'ʀ': 'r', 'ꜱ': 's', 'ᴀ': 'a', 'ᴇ': 'e', 'ᴏ': 'o',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'ω': 'w',
+}
+
+// leetspeak maps digits and symbols people swap in for letters.
+var leetspeak = map[rune]rune{
+	'0': 'o', '1': 'i', '2': 'z', '3': 'e', '4': 'a', '5': 's', '6': 'g', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '+': 't', '€': 'e', '£': 'l', '|': 'l',
+}
+
+type blockEntry struct {
+	id      int64
+	kind    string
+	pattern string
+	action  modAction
+	tokens  []string
+	regex   *regexp.Regexp
+}
+
+// blockMatcher is a channel's compiled blocklist: words in a set, phrases indexed by
+// first word and regexes behind one combined prefilter, so hundreds of terms stay cheap.
+type blockMatcher struct {
+	words   map[string]*blockEntry
+	phrases map[string][]*blockEntry
+	regexes []*blockEntry
+	any     *regexp.Regexp
+}
+
+var (
+	blocklistMutex    sync.Mutex
+	blocklistMatchers = make(map[string]*blockMatcher)
+)
+
+/* Normalization */
+
+// foldRunes decomposes accents away, folds homoglyphs and lowercases. With leet it also maps
+// digits to letters, and symbols too when a letter follows, so "sh!t" reads as a word but "word!" keeps its punctuation.
+func foldRunes(text string, leet bool) []rune {
+	var folded []rune
+	for _, r := range norm.NFKD.String(text) {
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if mapped, ok := homoglyphs[r]; ok {
+			r = mapped
+		}
+		folded = append(folded, r)
+	}
+	if !leet {
+		return folded
+	}
+
+	for i, r := range folded {
+		mapped, ok := leetspeak[r]
+		if !ok {
+			continue
+		}
+		if !unicode.IsDigit(r) {
+			next := i + 1
+			for next < len(folded) && isLeetSymbol(folded[next]) {
+				next++
+			}
+			if next == len(folded) || !(unicode.IsLetter(folded[next]) || unicode.IsDigit(folded[next])) {
+				continue
+			}
+		}
+		folded[i] = mapped
+	}
+	return folded
+}
+
+func isLeetSymbol(r rune) bool {
+	_, ok := leetspeak[r]
+	return ok && !unicode.IsDigit(r)
+}
+
+// BlocklistTokens splits the text into normalized words. Runs of single characters, like
+// "b a d" or "b.a.d", are also joined back into one word.
+func BlocklistTokens(text string, leet bool) []string {
+	var tokens []string
+	var word []rune
+	for _, r := range append(foldRunes(text, leet), ' ') {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+
+	joined := append([]string(nil), tokens...)
+	var run []string
+	for _, token := range append(tokens, "") {
+		if len([]rune(token)) == 1 {
+			run = append(run, token)
+			continue
+		}
+		if len(run) >= 3 {
+			joined = append(joined, strings.Join(run, ""))
+		}
+		run = run[:0]
+	}
+	return joined
+}
+
+/* Matching */
+
+func buildBlockMatcher(entries []*blockEntry) *blockMatcher {
+	m := &blockMatcher{words: make(map[string]*blockEntry), phrases: make(map[string][]*blockEntry)}
+	var alternatives []string
+	for _, entry := range entries {
+		switch entry.kind {
+		case "word":
+			for _, leet := range []bool{false, true} {
+				for _, token := range BlocklistTokens(entry.pattern, leet) {
+					m.words[token] = entry
+				}
+			}
+		case "phrase":
+			entry.tokens = BlocklistTokens(entry.pattern, false)
+			if len(entry.tokens) > 0 {
+				m.phrases[entry.tokens[0]] = append(m.phrases[entry.tokens[0]], entry)
+			}
+		case "regex":
+			re, err := regexp.Compile("(?i)" + entry.pattern)
+			if err != nil {
+				zap.S().Errorf("Skipping bad blocklist regex %v: %v", entry.pattern, err)
+				continue
+			}
+			entry.regex = re
+			m.regexes = append(m.regexes, entry)
+			alternatives = append(alternatives, "(?:"+entry.pattern+")")
+		}
+	}
+	if len(alternatives) > 0 {
+		m.any, _ = regexp.Compile("(?i)" + strings.Join(alternatives, "|"))
+	}
+	return m
+}
+
+// Match returns the first blocklist entry the text trips, checking plain and leetspeak readings.
+func (m *blockMatcher) Match(text string) *blockEntry {
+	for _, leet := range []bool{false, true} {
+		tokens := BlocklistTokens(text, leet)
+		for i, token := range tokens {
+			if entry, ok := m.words[token]; ok {
+				return entry
+			}
+			for _, entry := range m.phrases[token] {
+				if i+len(entry.tokens) > len(tokens) {
+					continue
+				}
+				matched := true
+				for j, want := range entry.tokens {
+					if tokens[i+j] != want {
+						matched = false
+						break
+					}
+				}
+				if matched {
+					return entry
+				}
+			}
+		}
+	}
+
+	if m.any == nil {
+		return nil
+	}
+	candidates := []string{text, string(foldRunes(text, false)), string(foldRunes(text, true))}
+	for _, candidate := range candidates {
+		if !m.any.MatchString(candidate) {
+			continue
+		}
+		for _, entry := range m.regexes {
+			if entry.regex.MatchString(candidate) {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+/* Blocklist Tables */
+
+func blocklistEntries(db *sql.DB) []*blockEntry {
+	rows, err := db.Query("SELECT id, kind, pattern, action FROM blocklist ORDER BY id;")
+	if err != nil {
+		handleSQLError(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []*blockEntry
+	for rows.Next() {
+		var (
+			entry  blockEntry
+			action string
+		)
+		if err := rows.Scan(&entry.id, &entry.kind, &entry.pattern, &action); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		entry.action, _ = parseModAction(action)
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+// BlocklistMatcher returns the channel's compiled blocklist, building it on first use.
+func BlocklistMatcher(ch broadcaster) *blockMatcher {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	m, ok := blocklistMatchers[ch.name]
+	if !ok {
+		m = buildBlockMatcher(blocklistEntries(ch.database))
+		blocklistMatchers[ch.name] = m
+	}
+	return m
+}
+
+func blocklistInvalidate(ch broadcaster) {
+	blocklistMutex.Lock()
+	delete(blocklistMatchers, ch.name)
+	blocklistMutex.Unlock()
+}
+
+func blocklistFilter(message twitch.PrivateMessage, ch broadcaster) *filterHit {
+	if !SettingGetBool("filter.blocklist.enabled", ch.database) || filterExempt("blocklist", message, ch) {
+		return nil
+	}
+	entry := BlocklistMatcher(ch).Match(message.Message)
+	if entry == nil {
+		return nil
+	}
+	// Repeat offenders escalate on the strike ladder, like every other filter's.
+	return &filterHit{filter: "blocklist", reason: fmt.Sprintf("blocked term #%d", entry.id), action: entry.action}
+}
+
+/* Commands */
+
+// BlocklistCommand handles !blocklist add <word|phrase|regex> <pattern> [action=<action>], remove <id>, list [kind] and test <message>.
+func BlocklistCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	usage := "Usage: !blocklist add <word|phrase|regex> <pattern> [action=<action>], !blocklist remove <id>, !blocklist list [kind], !blocklist test <message>"
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return usage
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "add":
+		if len(fields) < 3 {
+			return usage
+		}
+		kind := strings.ToLower(fields[1])
+		if kind != "word" && kind != "phrase" && kind != "regex" {
+			return "Blocklist entries are a word, phrase or regex."
+		}
+		action := modAction{kind: "delete"}
+		patternFields := fields[2:]
+		if last := patternFields[len(patternFields)-1]; strings.HasPrefix(strings.ToLower(last), "action=") {
+			var ok bool
+			if action, ok = parseModAction(last[len("action="):]); !ok {
+				return validModAction(last[len("action="):])
+			}
+			patternFields = patternFields[:len(patternFields)-1]
+		}
+		pattern := strings.Join(patternFields, " ")
+		if pattern == "" {
+			return usage
+		}
+		if kind == "word" && len(patternFields) > 1 {
+			kind = "phrase"
+		}
+		if kind == "regex" {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Sprintf("That regex doesn't compile: %v", err)
+			}
+		}
+		var id int64
+		err := ch.database.QueryRow("INSERT INTO blocklist (kind, pattern, action, addedby) VALUES ($1, $2, $3, $4) ON CONFLICT (kind, pattern) DO UPDATE SET action = EXCLUDED.action RETURNING id;", kind, pattern, action.String(), message.User.Name).Scan(&id)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't add that to the blocklist due to a SQL error."
+		}
+		blocklistInvalidate(ch)
+		CacheNotify(ch.name, "moderation")
+		return fmt.Sprintf("Blocklist #%d added (%s, %s).", id, kind, action)
+	case "remove":
+		if len(fields) < 2 {
+			return usage
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(fields[1], "#"), 10, 64)
+		if err != nil {
+			return "Remove blocklist entries by their number from !blocklist list."
+		}
+		res, err := ch.database.Exec("DELETE FROM blocklist WHERE id = $1;", id)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't remove that due to a SQL error."
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Sprintf("There's no blocklist entry #%d.", id)
+		}
+		blocklistInvalidate(ch)
+		CacheNotify(ch.name, "moderation")
+		return fmt.Sprintf("Blocklist #%d removed.", id)
+	case "list":
+		var parts []string
+		for _, entry := range blocklistEntries(ch.database) {
+			if len(fields) > 1 && !strings.EqualFold(fields[1], entry.kind) {
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("#%d %s:%s (%s)", entry.id, entry.kind, entry.pattern, entry.action))
+		}
+		if len(parts) == 0 {
+			return "The blocklist is empty."
+		}
+		// The terms are whatever chat mustn't see, so they only go to the mod who asked.
+		whisperMod(message.User.Name, "Blocklist: "+strings.Join(parts, ", "))
+		return fmt.Sprintf("The blocklist has %d entries, I've whispered them to {user}.", len(parts))
+	case "test":
+		text := strings.TrimSpace(options[strings.Index(strings.ToLower(options), "test")+len("test"):])
+		entry := BlocklistMatcher(ch).Match(text)
+		if entry == nil {
+			return "That message doesn't trip the blocklist."
+		}
+		whisperMod(message.User.Name, fmt.Sprintf("That trips blocklist #%d %s:%s (%s).", entry.id, entry.kind, entry.pattern, entry.action))
+		return fmt.Sprintf("That trips blocklist #%d (%s).", entry.id, entry.action)
+	default:
+		return usage
+	}
+}
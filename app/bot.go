@@ -3,10 +3,12 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
-	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/rds"
@@ -17,6 +19,8 @@ import (
 
 const (
 	oauthForm = "oauth:"
+	// Twitch drops chat messages longer than this.
+	maxMessageLength = 500
 	// First group is command, second group is optional permission, third group is options
 	// Add username possibility to the permission category
 	commandRegex = "^!(?P<trigger>\\S+) ?(?P<permission>\\+[emb])? ?(?P<options>.*)"
@@ -36,7 +40,7 @@ var RE *regexp.Regexp
 type broadcaster struct {
 	name      string
 	database  *sql.DB
-	commands  []string
+	store     ChannelStore
 	connected bool
 }
 
@@ -111,6 +115,45 @@ func ConnectedChannel(ch broadcaster) {
 	ch.connected = true
 }
 
+// SendChannelMessage says text in the channel, reporting the cases where Twitch would drop it.
+func SendChannelMessage(channel, text string) error {
+	if CLIENT == nil {
+		return errors.New("twitch client is not connected")
+	}
+	if err := channelMessageCheck(text); err != nil {
+		return err
+	}
+	CLIENT.Say(channel, text)
+	return nil
+}
+
+// truncateMessage shortens text to fit one chat message, cutting on a rune boundary and marking the cut with "...".
+func truncateMessage(text string) string {
+	if len(text) <= maxMessageLength {
+		return text
+	}
+	cut := maxMessageLength - 3
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "..."
+}
+
+// channelMessageCheck reports why Twitch would drop text, or nil if it can be sent.
+// Twitch never confirms delivery, so this is all the checking a message gets.
+func channelMessageCheck(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("message is empty")
+	}
+	if len(text) > maxMessageLength {
+		return fmt.Errorf("message is %d characters, the limit is %d", len(text), maxMessageLength)
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.New("message contains a line break")
+	}
+	return nil
+}
+
 /* Formatting */
 
 func FormatResponse(payload string, message twitch.PrivateMessage) string {
@@ -142,13 +185,6 @@ func FormatResponse(payload string, message twitch.PrivateMessage) string {
 
 /* GoRoutines - Subprocesses */
 
-func syncCommandList(ch broadcaster) {
-	for ch.connected {
-		time.Sleep(5 * time.Minute)
-		ch.commands = GetCommands(ch.database)
-	}
-}
-
 /* Run */
 
 func main() {
@@ -157,18 +193,23 @@ func main() {
 
 	zap.ReplaceGlobals(sugar)
 
+	if len(os.Args) > 1 {
+		os.Exit(RunCLI(os.Args[1:]))
+	}
+
 	zap.S().Info("Twitch Chatbot Starting up.")
 
 	zap.S().Info("Begin BotDB Preparation Stack.")
 	BotDBPrepare()
-	BotDBMainTablesPrepare()
 	zap.S().Info("BotDB Preparation Stack Complete.")
 
 	zap.S().Debug("Setting Environment Variables")
 	targets := strings.Split(BotDBBroadcasterList(), ";")
 	region := os.Getenv("AWS_REGION")
-	username = getAWSSecret("bot-username", region)
-	oauth = getAWSSecret("bot-oauth", region)
+	username = getSecret("bot-username", region)
+	oauth = getSecret("bot-oauth", region)
+	helixClientID = getSecret("bot-client-id", region)
+	helixClientSecret = getSecret("bot-client-secret", region)
 
 	OauthCheck()
 	channels = make(map[string]broadcaster)
@@ -194,25 +235,87 @@ func main() {
 		}
 		zap.S().Debugf("Users: %v\n", userlist)
 
-		DB := ChannelDBConnect(channelName)
-		comms := GetCommands(DB)
-		bc := broadcaster{name: channelName, database: DB, commands: comms, connected: true}
-		go syncCommandList(bc)
+		store := ChannelDBConnect(channelName)
+		if store == nil {
+			continue
+		}
+		store.Prepare()
+		bc := broadcaster{name: channelName, database: featureDB(store), store: CommandCache(store, channelName), connected: true}
+		zap.S().Infof("%v has %d commands", channelName, len(GetCommands(bc.store)))
+		if bc.database != nil {
+			go pointsPayout(bc)
+			go chatLogMaintain(bc)
+		}
 		channels[channelName] = bc
 	}
+	if listener, ok := STORE.(cacheListener); ok {
+		go CacheListen(listener.listenURL())
+	}
+	if helixClientID != "" {
+		go EventSubListen()
+	}
 
+	// The feature hooks only run in channels with a feature DB. Channels on a SQLite store just get commands.
 	CLIENT.OnPrivateMessage(func(message twitch.PrivateMessage) {
 		//zap.S().Debugf("%v - %v: %v\n", message.Channel, message.User.DisplayName, message.Message)
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			HistoryRecord(message)
+			ChatLogRecord(message, ch)
+			first := NewChatterTrack(message, ch)
+			if NameRuleSpeak(message, ch) || RaidObserve(message, ch) || ModerateMessage(message, ch) {
+				return
+			}
+			if first {
+				NewChatterWelcome(message, ch)
+			}
+			PointsTrackChatter(message, ch)
+			GiveawayObserve(message, ch)
+			PollObserve(message, ch)
+			TriviaObserve(message, ch)
+		}
 		if RE.MatchString(message.Message) {
 			zap.S().Debugf("##Possible Command detected in %v!##", message.Channel)
 			target := message.Channel
 			commandMessage := ProcessChannelCommand(message, channels[target])
 			if commandMessage != "" {
-				CLIENT.Say(target, commandMessage)
+				if err := SendChannelMessage(target, commandMessage); err != nil {
+					zap.S().Errorf("Couldn't send command response in %v: %v", target, err)
+				}
 			}
 		}
 	})
 
+	CLIENT.OnUserJoinMessage(func(message twitch.UserJoinMessage) {
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			RaidJoin(message, ch)
+			NameRuleJoin(message.User, ch)
+		}
+	})
+
+	CLIENT.OnUserNoticeMessage(func(message twitch.UserNoticeMessage) {
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			RaidIncoming(message, ch)
+		}
+	})
+
+	CLIENT.OnRoomStateMessage(func(message twitch.RoomStateMessage) {
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			RaidRoomState(message, ch)
+		}
+	})
+
+	CLIENT.OnClearChatMessage(func(message twitch.ClearChatMessage) {
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			ModlogClearChat(message, ch)
+		}
+	})
+
+	CLIENT.OnClearMessage(func(message twitch.ClearMessage) {
+		if ch, ok := channels[message.Channel]; ok && ch.database != nil {
+			ModlogClearMessage(message, ch)
+		}
+	})
+
 	CLIENT.OnWhisperMessage(func(message twitch.WhisperMessage) {
 		zap.S().Debugf("Whisper received from %v", message.User)
 		zap.S().Debugf("%v: %v\n", message.User.DisplayName, message.Message)
@@ -0,0 +1,265 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["chatlog.enabled"] = "true"
+	settingDefaults["chatlog.retentiondays"] = "30"
+}
+
+// chatLogBatch caps how many rows go into one INSERT when the buffer is flushed.
+const chatLogBatch = 500
+
+type chatLine struct {
+	sent      time.Time
+	messageID string
+	userID    string
+	userName  string
+	message   string
+	tags      string
+	session   string
+}
+
+// ChatLogQuery narrows a chat log search. Zero values match everything.
+type ChatLogQuery struct {
+	UserName string
+	Text     string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+var (
+	chatLogMutex sync.Mutex
+	// chatLogPending buffers lines between flushes so chat is written in batches, not a row per message.
+	chatLogPending = make(map[string][]chatLine)
+	// chatLogSessions is each channel's current stream id, or "" while offline.
+	chatLogSessions = make(map[string]string)
+)
+
+/* Chat Log Table */
+
+func chatLogPartitionName(day time.Time) string {
+	return "chatlog_" + day.Format("20060102")
+}
+
+// chatLogPartition creates the partition holding the given UTC day.
+func chatLogPartition(day time.Time, db *sql.DB) {
+	start := day.UTC().Truncate(24 * time.Hour)
+	end := start.AddDate(0, 0, 1)
+	statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF chatlog FOR VALUES FROM ('%s') TO ('%s')",
+		chatLogPartitionName(start), start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if _, err := db.Exec(statement); err != nil {
+		handleSQLError(err)
+	}
+}
+
+// chatLogExpire drops the partitions for days older than the channel's retention. Zero keeps everything.
+func chatLogExpire(ch broadcaster) {
+	days := SettingGetInt("chatlog.retentiondays", ch.database)
+	if days <= 0 {
+		return
+	}
+	cutoff := chatLogPartitionName(time.Now().UTC().AddDate(0, 0, -days))
+	rows, err := ch.database.Query("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = 'chatlog' AND p.relnamespace = current_schema()::regnamespace;")
+	if err != nil {
+		handleSQLError(err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil && len(name) == len(cutoff) && name < cutoff {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+
+	for _, name := range expired {
+		zap.S().Infof("Dropping expired chat log %v in %v", name, ch.name)
+		if _, err := ch.database.Exec("DROP TABLE IF EXISTS " + name); err != nil {
+			handleSQLError(err)
+		}
+	}
+}
+
+/* Writing */
+
+// ChatLogRecord buffers a chat message for the channel's log.
+func ChatLogRecord(message twitch.PrivateMessage, ch broadcaster) {
+	if ch.database == nil || !SettingGetBool("chatlog.enabled", ch.database) {
+		return
+	}
+	tags, err := json.Marshal(message.Tags)
+	if err != nil {
+		tags = []byte("{}")
+	}
+	chatLogMutex.Lock()
+	chatLogPending[ch.name] = append(chatLogPending[ch.name], chatLine{
+		sent:      time.Now().UTC(),
+		messageID: message.ID,
+		userID:    message.User.ID,
+		userName:  message.User.Name,
+		message:   message.Message,
+		tags:      string(tags),
+		session:   chatLogSessions[ch.name],
+	})
+	chatLogMutex.Unlock()
+}
+
+// chatLogFlush writes the buffered lines in multi-row inserts. Lines that fail to write are dropped
+// rather than held, so an outage can't grow the buffer without bound.
+func chatLogFlush(ch broadcaster) {
+	chatLogMutex.Lock()
+	lines := chatLogPending[ch.name]
+	delete(chatLogPending, ch.name)
+	chatLogMutex.Unlock()
+
+	for len(lines) > 0 {
+		batch := lines
+		if len(batch) > chatLogBatch {
+			batch = batch[:chatLogBatch]
+		}
+		lines = lines[len(batch):]
+
+		values := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, 7*len(batch))
+		for i, line := range batch {
+			n := 7 * i
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+			args = append(args, line.sent, line.messageID, line.userID, line.userName, line.message, line.tags, line.session)
+		}
+		_, err := ch.database.Exec("INSERT INTO chatlog (sent, messageid, userid, username, message, tags, session) VALUES "+strings.Join(values, ", ")+";", args...)
+		if err != nil {
+			zap.S().Errorf("Dropping %d chat log lines in %v", len(batch), ch.name)
+			handleSQLError(err)
+		}
+	}
+}
+
+// chatLogMaintain flushes the channel's log every few seconds, follows the stream session,
+// and keeps partitions ahead of the clock while expiring old ones.
+func chatLogMaintain(ch broadcaster) {
+	var lastSession, lastPartition time.Time
+	// Today's partition has to be there for the first flush. The loop keeps tomorrow's ready.
+	chatLogPartition(time.Now(), ch.database)
+	for ch.connected {
+		time.Sleep(5 * time.Second)
+		chatLogFlush(ch)
+
+		if time.Since(lastSession) > time.Minute {
+			lastSession = time.Now()
+			if session, err := HelixStreamID(ch.name); err == nil {
+				chatLogMutex.Lock()
+				chatLogSessions[ch.name] = session
+				chatLogMutex.Unlock()
+			} else if err != errHelixDisabled {
+				zap.S().Errorf("Couldn't check the stream session for %v: %v", ch.name, err)
+			}
+		}
+		if time.Since(lastPartition) > time.Hour {
+			lastPartition = time.Now()
+			chatLogPartition(lastPartition.AddDate(0, 0, 1), ch.database)
+			chatLogExpire(ch)
+		}
+	}
+}
+
+/* Reading */
+
+// ChatLogSearch returns matching lines from the channel's log, newest first.
+func ChatLogSearch(q ChatLogQuery, db *sql.DB) ([]chatLine, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(clause, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if q.UserName != "" {
+		add("username = ?", strings.ToLower(q.UserName))
+	}
+	if q.Text != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Text)
+		add("message ILIKE '%' || ? || '%'", escaped)
+	}
+	if !q.Since.IsZero() {
+		add("sent >= ?", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		add("sent < ?", q.Until.UTC())
+	}
+	query := "SELECT sent, messageid, userid, username, message, tags, session FROM chatlog"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := q.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+	query += " ORDER BY sent DESC LIMIT " + strconv.Itoa(limit) + ";"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []chatLine
+	for rows.Next() {
+		var line chatLine
+		if err := rows.Scan(&line.sent, &line.messageID, &line.userID, &line.userName, &line.message, &line.tags, &line.session); err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// LogsCommand handles !logs <user> [n], showing the user's last few messages.
+func LogsCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return "Usage: !logs <user> [n]"
+	}
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	n := 5
+	if len(fields) > 1 {
+		var err error
+		if n, err = strconv.Atoi(fields[1]); err != nil || n < 1 {
+			return "Usage: !logs <user> [n]"
+		}
+		if n > 10 {
+			n = 10
+		}
+	}
+
+	chatLogFlush(ch)
+	lines, err := ChatLogSearch(ChatLogQuery{UserName: target, Limit: n}, ch.database)
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't read the chat log due to a SQL error."
+	}
+	if len(lines) == 0 {
+		return fmt.Sprintf("I have no messages from %s.", target)
+	}
+	parts := make([]string, 0, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("[%s] %s", lines[i].sent.Format("01-02 15:04"), lines[i].message))
+	}
+	// The lines may include messages that were deleted or got the chatter timed out, so they're whispered.
+	whisperMod(message.User.Name, target+": "+strings.Join(parts, " | "))
+	return fmt.Sprintf("I've whispered {user} the last %d messages from %s.", len(lines), target)
+}
@@ -0,0 +1,252 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const cliUsage = `Usage:
+  bot modlog-export <channel> [user]       write the channel's modlog as CSV
+  bot logs-search <channel> <text> [user]  search the channel's chat log
+  bot trivia-import <channel> <file>       add a local JSON or CSV question pack to the channel's trivia bank
+  bot migrate [status|up]                  show or apply migrations for the bot DB and every channel DB
+  bot migrate down <version> [channel [features]]
+                                           roll the bot DB, or one channel's tables or features, back to a version
+  bot tenant-import [channel...]           copy channels from their own DBs into the shared one (DB_TENANCY=shared)
+  bot export <channel>                     write the channel's commands, quotes, users and features as JSON
+  bot restore <channel> [file]             add what's missing from an export to the channel, reading stdin without a file`
+
+// RunCLI handles the maintenance subcommands that run instead of the bot, returning the exit code.
+func RunCLI(args []string) int {
+	if len(args) > 0 && args[0] == "migrate" {
+		return runMigrate(args[1:])
+	}
+	if len(args) > 0 && args[0] == "tenant-import" {
+		store, err := StoreOpen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't open the store: %v\n", err)
+			return 1
+		}
+		STORE = store
+		if err := TenantImportRun(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "tenant-import failed: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	if args[0] == "export" || args[0] == "restore" {
+		return runArchive(args)
+	}
+	var run func(db *sql.DB, args []string) error
+	switch args[0] {
+	case "modlog-export":
+		run = func(db *sql.DB, args []string) error {
+			user := ""
+			if len(args) > 0 {
+				user = args[0]
+			}
+			return ModlogExport(user, db, os.Stdout)
+		}
+	case "trivia-import":
+		run = func(db *sql.DB, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("trivia-import needs a JSON or CSV pack to read")
+			}
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			questions, err := readTriviaPack(file)
+			if err != nil {
+				return err
+			}
+			added, err := TriviaImport(questions, db)
+			fmt.Printf("Imported %d new trivia questions\n", added)
+			return err
+		}
+	case "logs-search":
+		run = func(db *sql.DB, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("logs-search needs some text to look for")
+			}
+			q := ChatLogQuery{Text: args[0]}
+			if len(args) > 1 {
+				q.UserName = args[1]
+			}
+			lines, err := ChatLogSearch(q, db)
+			for _, line := range lines {
+				fmt.Printf("%s %s: %s\n", line.sent.Format("2006-01-02 15:04:05"), line.userName, line.message)
+			}
+			return err
+		}
+	default:
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+
+	store, err := StoreOpen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't open the store: %v\n", err)
+		return 1
+	}
+	STORE = store
+	st := ChannelDBConnect(strings.ToLower(args[1]))
+	if st == nil {
+		return 1
+	}
+	if err := run(st.DB(), args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func runArchive(args []string) int {
+	if args[0] == "export" {
+		store, err := StoreOpen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't open the store: %v\n", err)
+			return 1
+		}
+		STORE = store
+		if err := ExportRun(strings.ToLower(args[1]), os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	in := os.Stdin
+	if len(args) > 2 {
+		file, err := os.Open(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't open the archive: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+	// Restoring may be the first thing a new deployment does, so the bot DB is migrated as on startup.
+	BotDBPrepare()
+	if err := RestoreRun(args[1], in); err != nil {
+		fmt.Fprintf(os.Stderr, "restore failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// schemaTarget is one database for `bot migrate` to look at.
+type schemaTarget struct {
+	name string
+	db   *sql.DB
+	set  string
+}
+
+func runMigrate(args []string) int {
+	store, err := StoreOpen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't open the store: %v\n", err)
+		return 1
+	}
+	STORE = store
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "status", "up":
+		// The bot DB goes first, since the list of channel DBs is kept in it.
+		status := migrateReport(action, schemaTarget{"bot", store.DB(), store.MigrationSet()})
+		names, err := store.Broadcasters()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't list the channels: %v\n", err)
+			return 1
+		}
+		for _, name := range names {
+			st := ChannelDBConnect(name)
+			if st == nil {
+				status = 1
+				continue
+			}
+			for _, set := range st.MigrationSets() {
+				if migrateReport(action, schemaTarget{setLabel(name, set), st.DB(), set}) != 0 {
+					status = 1
+				}
+			}
+		}
+		return status
+	case "down":
+		if len(args) < 2 {
+			break
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			break
+		}
+		target := schemaTarget{"bot", store.DB(), store.MigrationSet()}
+		if len(args) > 2 {
+			st := ChannelDBConnect(strings.ToLower(args[2]))
+			if st == nil {
+				return 1
+			}
+			sets := st.MigrationSets()
+			if len(sets) == 0 {
+				fmt.Fprintf(os.Stderr, "%s lives in the bot DB; roll back the bot DB instead\n", args[2])
+				return 1
+			}
+			// The core tables are rolled back unless the features are asked for.
+			set := sets[0]
+			if len(args) > 3 && args[3] == "features" {
+				set = sets[len(sets)-1]
+			}
+			target = schemaTarget{setLabel(args[2], set), st.DB(), set}
+		}
+		version, err = Migrate(target.db, target.set, version)
+		fmt.Printf("%s: version %d\n", target.name, version)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", target.name, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, cliUsage)
+	return 2
+}
+
+// setLabel names a channel's migration set for the report, since a channel database has two.
+func setLabel(name, set string) string {
+	if set == "postgres/features" {
+		return name + " features"
+	}
+	return name
+}
+
+// migrateReport migrates the database up, or only reads its version for status, and prints where it stands.
+func migrateReport(action string, target schemaTarget) int {
+	var (
+		version int
+		err     error
+	)
+	if action == "up" {
+		version, err = Migrate(target.db, target.set, -1)
+	} else {
+		version, err = SchemaVersion(target.db, target.set)
+	}
+	migrations, _ := loadMigrations(target.set)
+	fmt.Printf("%s: version %d of %d\n", target.name, version, len(migrations))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", target.name, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The command cache holds every channel's full command records, so running a command never reaches the
+// database. A channel's commands are loaded on first use and kept current by cachedChannel, which every
+// add, edit and remove goes through, and which tells other instances to drop theirs.
+
+var (
+	commandCacheMutex sync.RWMutex
+	// commandCaches is each loaded channel's commands by trigger.
+	commandCaches = make(map[string]map[string]command)
+	// commandCacheGenerations counts the changes to each channel's cache, so a load that raced a change is thrown away.
+	commandCacheGenerations = make(map[string]int)
+)
+
+// cachedChannel is a ChannelStore that answers command reads from the cache and updates it on every write.
+type cachedChannel struct {
+	ChannelStore
+	channel string
+}
+
+// CommandCache puts the channel's store behind the command cache.
+func CommandCache(st ChannelStore, channel string) ChannelStore {
+	return cachedChannel{st, channel}
+}
+
+// commandCacheInvalidate drops the channel's commands, to be loaded again on next use.
+func commandCacheInvalidate(channel string) {
+	commandCacheMutex.Lock()
+	delete(commandCaches, channel)
+	commandCacheGenerations[channel]++
+	commandCacheMutex.Unlock()
+}
+
+// load fills the channel's cache from the store if it isn't already. A change made while the
+// store is being read means the read may have missed it, so it's read again.
+func (c cachedChannel) load() error {
+	for {
+		commandCacheMutex.RLock()
+		_, loaded := commandCaches[c.channel]
+		generation := commandCacheGenerations[c.channel]
+		commandCacheMutex.RUnlock()
+		if loaded {
+			return nil
+		}
+
+		comms, err := c.ChannelStore.Commands()
+		if err != nil {
+			return err
+		}
+		cache := make(map[string]command, len(comms))
+		for _, comm := range comms {
+			cache[comm.trigger] = comm
+		}
+		commandCacheMutex.Lock()
+		current := commandCacheGenerations[c.channel] == generation
+		if current {
+			commandCaches[c.channel] = cache
+		}
+		commandCacheMutex.Unlock()
+		if current {
+			zap.S().Debugf("Loaded %d commands for %v", len(comms), c.channel)
+			return nil
+		}
+	}
+}
+
+// read runs fn on the channel's commands under the read lock, loading them first if need be.
+func (c cachedChannel) read(fn func(cache map[string]command)) error {
+	for {
+		if err := c.load(); err != nil {
+			return err
+		}
+		commandCacheMutex.RLock()
+		cache, ok := commandCaches[c.channel]
+		if ok {
+			fn(cache)
+		}
+		commandCacheMutex.RUnlock()
+		// Invalidated between loading and reading.
+		if ok {
+			return nil
+		}
+	}
+}
+
+// set records a change, or removes the command when comm is nil. A channel that isn't loaded yet
+// will read the change from the store when it is.
+func (c cachedChannel) set(trigger string, comm *command) {
+	commandCacheMutex.Lock()
+	defer commandCacheMutex.Unlock()
+	commandCacheGenerations[c.channel]++
+	cache, ok := commandCaches[c.channel]
+	if !ok {
+		return
+	}
+	if comm == nil {
+		delete(cache, trigger)
+	} else {
+		cache[trigger] = *comm
+	}
+}
+
+func (c cachedChannel) Commands() ([]command, error) {
+	var comms []command
+	err := c.read(func(cache map[string]command) {
+		comms = make([]command, 0, len(cache))
+		for _, comm := range cache {
+			comms = append(comms, comm)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(comms, func(i, j int) bool { return comms[i].trigger < comms[j].trigger })
+	return comms, nil
+}
+
+func (c cachedChannel) CommandTriggers() ([]string, error) {
+	comms, err := c.Commands()
+	triggers := make([]string, len(comms))
+	for i, comm := range comms {
+		triggers[i] = comm.trigger
+	}
+	return triggers, err
+}
+
+// Command returns sql.ErrNoRows for a trigger that isn't cached, since the cache holds every command.
+func (c cachedChannel) Command(trigger string) (command, error) {
+	var (
+		comm command
+		ok   bool
+	)
+	err := c.read(func(cache map[string]command) { comm, ok = cache[trigger] })
+	if err != nil {
+		return command{}, err
+	}
+	if !ok {
+		return command{}, sql.ErrNoRows
+	}
+	return comm, nil
+}
+
+func (c cachedChannel) CommandInsert(comm command) error {
+	if err := c.ChannelStore.CommandInsert(comm); err != nil {
+		return err
+	}
+	c.set(comm.trigger, &comm)
+	CacheNotify(c.channel, "command")
+	return nil
+}
+
+func (c cachedChannel) CommandUpdate(comm command) (bool, error) {
+	found, err := c.ChannelStore.CommandUpdate(comm)
+	if err == nil && found {
+		c.set(comm.trigger, &comm)
+		CacheNotify(c.channel, "command")
+	}
+	return found, err
+}
+
+// CommandRemove drops the trigger from the cache even when the store didn't have it, since then the cache was wrong.
+func (c cachedChannel) CommandRemove(trigger string) (bool, error) {
+	found, err := c.ChannelStore.CommandRemove(trigger)
+	if err == nil {
+		c.set(trigger, nil)
+		CacheNotify(c.channel, "command")
+	}
+	return found, err
+}
+
+func (c cachedChannel) QuoteAdd(text, addedBy string) (int, error) {
+	id, err := c.ChannelStore.QuoteAdd(text, addedBy)
+	if err == nil {
+		CacheNotify(c.channel, "quote")
+	}
+	return id, err
+}
+
+func (c cachedChannel) QuoteImport(q quote) error {
+	err := c.ChannelStore.QuoteImport(q)
+	if err == nil {
+		CacheNotify(c.channel, "quote")
+	}
+	return err
+}
@@ -2,14 +2,25 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gempir/go-twitch-irc/v2"
 	"go.uber.org/zap"
 )
 
+var (
+	cooldownMutex sync.Mutex
+	cooldowns     = make(map[string]time.Time)
+)
+
 /* Commands */
+
+// ProcessUserPermissions maps a user's badges to their level: b for broadcaster, m for moderator, i for VIP, s for subscriber and v for everyone else.
 func ProcessUserPermissions(userBadges map[string]int) string {
 	var userLevel string
 	if userBadges["broadcaster"] == 1 {
@@ -18,6 +29,12 @@ func ProcessUserPermissions(userBadges map[string]int) string {
 	} else if userBadges["moderator"] == 1 {
 		zap.S().Debug("User is a moderator")
 		userLevel = "m"
+	} else if userBadges["vip"] == 1 {
+		zap.S().Debug("User is a VIP")
+		userLevel = "i"
+	} else if userBadges["subscriber"] > 0 || userBadges["founder"] > 0 {
+		zap.S().Debug("User is a subscriber")
+		userLevel = "s"
 	} else {
 		zap.S().Debug("User is a viewer")
 		userLevel = "v"
@@ -45,8 +62,8 @@ func AuthorizeCommand(userLevel, username, permissionLevel string) bool {
 	}
 }
 
-func ProcessUserBits(userBadges map[string]int) int {
-	bits := userBadges["bits"]
+func ProcessUserBits(tags map[string]string) int {
+	bits, _ := strconv.Atoi(tags["bits"])
 	return bits
 }
 
@@ -55,6 +72,114 @@ func ProcessUserSubscription(tags map[string]string) string {
 	return subscriberTime
 }
 
+// SubscriberMonths reads the cumulative months out of a badge-info value like "subscriber/14".
+func SubscriberMonths(badgeInfo string) int {
+	for _, info := range strings.Split(badgeInfo, ",") {
+		pair := strings.SplitN(info, "/", 2)
+		if len(pair) == 2 && (pair[0] == "subscriber" || pair[0] == "founder") {
+			months, _ := strconv.Atoi(pair[1])
+			return months
+		}
+	}
+	return 0
+}
+
+// parseChatDuration reads durations typed in chat, like 90s or 5m. A bare number means minutes.
+func parseChatDuration(value string) (time.Duration, bool) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		return time.Duration(minutes) * time.Minute, minutes > 0
+	}
+	duration, err := time.ParseDuration(value)
+	return duration, err == nil && duration > 0
+}
+
+// commandPermission turns the +e/+m/+b flag from !addcommand into the level AuthorizeCommand expects.
+func commandPermission(flag string) string {
+	level := strings.TrimPrefix(strings.ToLower(flag), "+")
+	if level == "e" {
+		return ""
+	}
+	return level
+}
+
+// parseCommandOptions strips leading cooldown=N and cost=N options off a command payload into comm.
+func parseCommandOptions(payload string, comm *command) string {
+	fields := strings.Fields(payload)
+	for len(fields) > 0 {
+		pair := strings.SplitN(fields[0], "=", 2)
+		if len(pair) != 2 {
+			break
+		}
+		value, err := strconv.Atoi(pair[1])
+		if err != nil || value < 0 {
+			break
+		}
+		switch strings.ToLower(pair[0]) {
+		case "cooldown":
+			comm.cooldown = value
+		case "cost":
+			comm.cost = value
+		default:
+			return strings.Join(fields, " ")
+		}
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
+
+// commandOnCooldown reports whether comm was used within its cooldown.
+func commandOnCooldown(comm command, ch broadcaster) bool {
+	if comm.cooldown <= 0 {
+		return false
+	}
+	cooldownMutex.Lock()
+	defer cooldownMutex.Unlock()
+	last, ok := cooldowns[ch.name+"/"+comm.trigger]
+	return ok && time.Since(last) < time.Duration(comm.cooldown)*time.Second
+}
+
+func commandUsed(comm command, ch broadcaster) {
+	if comm.cooldown <= 0 {
+		return
+	}
+	cooldownMutex.Lock()
+	cooldowns[ch.name+"/"+comm.trigger] = time.Now()
+	cooldownMutex.Unlock()
+}
+
+// ChargedCommand takes the command's cost from the invoker and sends the response itself. The response is checked
+// before anyone is charged, since Twitch doesn't report messages it drops and there's no failure to refund on after.
+// It returns any message that should still go to chat, such as a can't-afford notice.
+func ChargedCommand(message twitch.PrivateMessage, comm command, ch broadcaster) string {
+	response := FormatResponse(comm.payload, message)
+	if err := channelMessageCheck(response); err != nil {
+		zap.S().Errorf("!%v can't be sent, so %v wasn't charged: %v", comm.trigger, message.User.Name, err)
+		return ""
+	}
+	if ch.database == nil {
+		return fmt.Sprintf("Sorry, !%s costs points, and this channel's SQLite store doesn't keep them.", comm.trigger)
+	}
+	name := SettingGet("points.name", ch.database)
+	cost := int64(comm.cost)
+	err := WithTx(ch.database, func(tx *sql.Tx) error {
+		_, err := PointsAdjust(tx, message.User.ID, message.User.Name, -cost, "command:"+comm.trigger)
+		return err
+	})
+	if err == errInsufficientPoints {
+		balance := PointsBalance(message.User.ID, ch.database)
+		return FormatResponse(fmt.Sprintf("Sorry {user}, !%s costs %d %s and you have %d.", comm.trigger, cost, name, balance), message)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't charge for that command due to a SQL error."
+	}
+
+	commandUsed(comm, ch)
+	if err := SendChannelMessage(ch.name, response); err != nil {
+		zap.S().Errorf("Couldn't send !%v after charging %v: %v", comm.trigger, message.User.Name, err)
+	}
+	return ""
+}
+
 func ProcessWhisperCommand(message twitch.WhisperMessage) string {
 	zap.S().Debug("Processing Whisper Command")
 
@@ -77,6 +202,19 @@ func ProcessWhisperCommand(message twitch.WhisperMessage) string {
 			BroadcasterAuthorize(options)
 			resultMessage = fmt.Sprintf("Authorizing %s as a broadcaster.", options)
 		}
+	case "triviaimport":
+		if strings.ToLower(username) != "hikthur" {
+			resultMessage = "I'm sorry, only Hikthur can change the default trivia bank."
+		} else if !botDBPostgres() {
+			resultMessage = "The default trivia bank needs a Postgres bot DB, this one is SQLite."
+		} else if questions, err := fetchTriviaPack(strings.TrimSpace(options)); err != nil {
+			resultMessage = fmt.Sprintf("I couldn't import that pack: %v", err)
+		} else if added, err := TriviaImport(questions, BOTDB); err != nil {
+			handleSQLError(err)
+			resultMessage = "I couldn't import that pack due to a SQL error."
+		} else {
+			resultMessage = fmt.Sprintf("Imported %d new questions into the default trivia bank.", added)
+		}
 	default:
 		zap.S().Debug("Not a bot level command, passing back no command message.")
 		resultMessage = "That is not a command I understand, please contact Hikthur with what you're trying to do."
@@ -84,6 +222,15 @@ func ProcessWhisperCommand(message twitch.WhisperMessage) string {
 	return resultMessage
 }
 
+// featureCommands are the built-in commands that need the channel's feature tables, so don't work on a SQLite store.
+var featureCommands = map[string]bool{
+	"points": true, "give": true, "addpoints": true, "removepoints": true, "top": true,
+	"giveaway": true, "enter": true, "poll": true, "vote": true, "bet": true, "queue": true, "trivia": true,
+	"gamble": true, "duel": true, "accept": true, "decline": true, "regular": true, "blocklist": true,
+	"permit": true, "allowlist": true, "strike": true, "strikes": true, "modlog": true, "lockdown": true,
+	"namerule": true, "sharedban": true, "logs": true, "setting": true,
+}
+
 func ProcessChannelCommand(message twitch.PrivateMessage, ch broadcaster) string {
 	zap.S().Debugf("Executing a command")
 
@@ -96,6 +243,9 @@ func ProcessChannelCommand(message twitch.PrivateMessage, ch broadcaster) string
 	userName := message.User.Name
 	userPermissionLevel := ProcessUserPermissions(message.User.Badges) //Pre-processed by twitchirc
 	var requiredPermission string
+	if ch.database == nil && featureCommands[trigger] {
+		return "Sorry, this channel's on a SQLite store, which only keeps commands, quotes and users."
+	}
 	switch trigger {
 	case "addcommand":
 		requiredPermission = "m"
@@ -106,13 +256,32 @@ func ProcessChannelCommand(message twitch.PrivateMessage, ch broadcaster) string
 			if len(submatch) == 0 {
 				result = "I'm sorry, I can't add that command for some reason."
 			} else {
-				newTrigger := submatch[1]
-				newLevel := strings.ToLower(submatch[2])
-				newPayload := submatch[3]
-				zap.S().Debugf("Adding command with trigger: %v, level: %v, payload: %v", newTrigger, newLevel, newPayload)
-				result = CommandDBInsert(newTrigger, newPayload, newLevel, 0, ch.database)
-				if result != "I couldn't add that command due to a SQL error." {
-					ch.commands = append(ch.commands, newTrigger)
+				newComm := command{trigger: strings.ToLower(submatch[1]), permission: commandPermission(submatch[2])}
+				newComm.payload = parseCommandOptions(submatch[3], &newComm)
+				zap.S().Debugf("Adding command with trigger: %v, level: %v, cooldown: %v, cost: %v, payload: %v", newComm.trigger, newComm.permission, newComm.cooldown, newComm.cost, newComm.payload)
+				result = CommandDBInsert(newComm.trigger, newComm.payload, newComm.permission, newComm.cooldown, newComm.cost, ch.store)
+			}
+		}
+	case "editcommand":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			submatch = RE.FindStringSubmatch(options)
+			if len(submatch) == 0 {
+				result = "I'm sorry, you didn't supply a command I understand."
+			} else {
+				editComm := CommandDBSelect(strings.ToLower(submatch[1]), ch.store)
+				if editComm.trigger == "" {
+					result = "There's no command called " + submatch[1] + "."
+				} else {
+					if submatch[2] != "" {
+						editComm.permission = commandPermission(submatch[2])
+					}
+					if payload := parseCommandOptions(submatch[3], &editComm); payload != "" {
+						editComm.payload = payload
+					}
+					result = CommandDBUpdate(editComm, ch.store)
 				}
 			}
 		}
@@ -126,7 +295,7 @@ func ProcessChannelCommand(message twitch.PrivateMessage, ch broadcaster) string
 				result = "I'm sorry, you didn't supply a command I understand."
 			} else {
 				deleteTrigger := submatch[1]
-				result = CommandDBRemove(deleteTrigger, ch.database)
+				result = CommandDBRemove(deleteTrigger, ch.store)
 			}
 		}
 	case "connectiontest":
@@ -136,30 +305,142 @@ func ProcessChannelCommand(message twitch.PrivateMessage, ch broadcaster) string
 		} else {
 			result = "The bot has succesfully latched on to this channel."
 		}
+	case "points":
+		result = PointsCommand(message, options, ch)
+	case "give":
+		result = PointsGiveCommand(message, options, ch)
+	case "addpoints", "removepoints":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else if trigger == "addpoints" {
+			result = PointsModCommand(message, options, 1, ch)
+		} else {
+			result = PointsModCommand(message, options, -1, ch)
+		}
+	case "top":
+		result = PointsTopCommand(options, ch)
+	case "giveaway":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = GiveawayCommand(message, options, ch)
+		}
+	case "enter":
+		result = GiveawayEnter(message, ch)
+	case "poll":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = PollCommand(message, options, ch)
+		}
+	case "vote":
+		result = PollVote(message, options, ch)
+	case "bet":
+		result = BetCommand(message, options, userPermissionLevel, ch)
+	case "queue":
+		result = QueueCommand(message, options, userPermissionLevel, ch)
+	case "trivia":
+		result = TriviaCommand(message, options, userPermissionLevel, ch)
+	case "gamble":
+		result = GambleCommand(message, options, ch)
+	case "duel":
+		result = DuelCommand(message, options, ch)
+	case "accept", "decline":
+		result = DuelAnswer(message, trigger == "accept", ch)
+	case "regular":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = RegularCommand(message, options, ch)
+		}
+	case "blocklist":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = BlocklistCommand(message, options, ch)
+		}
+	case "permit", "allowlist":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else if trigger == "permit" {
+			result = PermitCommand(options, ch)
+		} else {
+			result = AllowlistCommand(options, ch)
+		}
+	case "strike", "strikes":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else if trigger == "strike" {
+			result = StrikeCommand(message, options, ch)
+		} else {
+			result = StrikesCommand(options, ch)
+		}
+	case "modlog":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = ModlogCommand(message, options, ch)
+		}
+	case "lockdown":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = LockdownCommand(options, ch)
+		}
+	case "namerule":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = NameRuleCommand(message, options, ch)
+		}
+	case "sharedban":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = SharedBanCommand(message, options, ch)
+		}
+	case "logs":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = LogsCommand(message, options, ch)
+		}
+	case "setting":
+		requiredPermission = "m"
+		if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+			result = ""
+		} else {
+			result = SettingCommand(options, ch)
+		}
 	case "help":
 		result = "This bot is being helpful!"
 	default:
-		zap.S().Infof("Verifying command %v is in the channel's list.", trigger)
-		available := false
-		for _, comm := range ch.commands {
-			if trigger == comm {
-				available = true
-				break
-			}
-		}
-		if !available {
-			zap.S().Infof("Couldn't find the %v command.", trigger)
+		comm := CommandDBSelect(trigger, ch.store)
+		if comm.trigger == "" {
+			zap.S().Debugf("Couldn't find the %v command.", trigger)
 			return ""
-		}
-		zap.S().Infof("Command is in the list, querying DB.")
-		res, requiredPermission := CommandDBSelect(trigger, ch.database)
-		if res == "" {
-			zap.S().Infof("Couldn't find the %v command in the DB. This only happens if it was removed in the last 5 minutes.", trigger)
-			result = "Command recently deleted."
-		} else if !AuthorizeCommand(userPermissionLevel, userName, requiredPermission) {
+		} else if !AuthorizeCommand(userPermissionLevel, userName, comm.permission) {
 			result = "Sorry, you're not authorized to use this command {user}."
+		} else if commandOnCooldown(comm, ch) {
+			zap.S().Debugf("Command %v is on cooldown.", trigger)
+			return ""
+		} else if comm.cost > 0 {
+			return ChargedCommand(message, comm, ch)
 		} else {
-			result = res
+			commandUsed(comm, ch)
+			result = comm.payload
 		}
 	}
 
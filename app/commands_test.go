@@ -1,2 +1,117 @@
 // Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
 package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCommandCache(t *testing.T) {
+	store := testSQLiteStore(t)
+	direct := testChannel(t, store, "cached")
+	cached := CommandCache(direct, "cached")
+	t.Cleanup(func() { commandCacheInvalidate("cached") })
+
+	CommandDBInsert("hello", "hi", "e", 0, 0, cached)
+	edit := CommandDBSelect("hello", cached)
+	edit.payload = "hey"
+	CommandDBUpdate(edit, cached)
+	CommandDBInsert("bye", "cya", "e", 0, 0, cached)
+	CommandDBRemove("bye", cached)
+
+	// A change made behind the cache's back, as another bot instance would, isn't seen until it's invalidated.
+	CommandDBInsert("other", "from elsewhere", "e", 0, 0, direct)
+	if got := GetCommands(cached); len(got) != 1 || got[0] != "hello" {
+		t.Fatalf("cached triggers = %q, want [hello]", got)
+	}
+	if got := CommandDBSelect("hello", cached); got.payload != "hey" {
+		t.Fatalf("cached hello = %+v after editing", got)
+	}
+	commandCacheInvalidate("cached")
+	if got := GetCommands(cached); len(got) != 2 {
+		t.Fatalf("triggers after invalidating = %q, want [hello other]", got)
+	}
+
+	// Once loaded, running a command doesn't need the database at all.
+	store.DB().Close()
+	if got := CommandDBSelect("other", cached); got.payload != "from elsewhere" {
+		t.Fatalf("cached other = %+v with the database closed", got)
+	}
+}
+
+func TestCacheInvalidateFromAnotherInstance(t *testing.T) {
+	store := testSQLiteStore(t)
+	direct := testChannel(t, store, "notified")
+	cached := CommandCache(direct, "notified")
+	saved := channels
+	channels = map[string]broadcaster{"notified": {name: "notified", database: direct.DB(), store: cached}}
+	t.Cleanup(func() {
+		channels = saved
+		commandCacheInvalidate("notified")
+	})
+
+	GetCommands(cached)
+	CommandDBInsert("elsewhere", "added by the other instance", "e", 0, 0, direct)
+	cacheInvalidate(cacheEvent{Instance: "other", Channel: "unknown", Entity: "command"})
+	if got := GetCommands(cached); len(got) != 0 {
+		t.Fatalf("an event for another channel dropped this one's cache: %q", got)
+	}
+	cacheInvalidate(cacheEvent{Instance: "other", Channel: "notified", Entity: "command"})
+	if got := GetCommands(cached); len(got) != 1 {
+		t.Fatalf("triggers after the other instance's change = %q, want [elsewhere]", got)
+	}
+}
+
+func TestParsePoll(t *testing.T) {
+	for _, c := range []struct {
+		options  string
+		choices  []string
+		duration time.Duration
+		ok       bool
+	}{
+		{`"Best?" Season 2 | Season 3`, []string{"Season 2", "Season 3"}, 0, true},
+		{`"Best?" Season 2 | Season 3 90s`, []string{"Season 2", "Season 3"}, 90 * time.Second, true},
+		{`"Best?" yes | no 5m`, []string{"yes", "no"}, 5 * time.Minute, true},
+		{`"Best?" yes | no 3`, []string{"yes", "no 3"}, 0, true},
+		{`"Best?" yes | 5m`, []string{"yes", "5m"}, 0, true},
+		{`"Best?" yes`, nil, 0, false},
+		{`Best? yes | no`, nil, 0, false},
+	} {
+		question, choices, duration, ok := parsePoll(c.options)
+		if ok != c.ok || duration != c.duration || !reflect.DeepEqual(choices, c.choices) || (ok && question != "Best?") {
+			t.Errorf("parsePoll(%s) = %q, %q, %v, %v", c.options, question, choices, duration, ok)
+		}
+	}
+}
+
+func TestTriviaPackAddresses(t *testing.T) {
+	for _, url := range []string{
+		"https://127.0.0.1/pack.json",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.5/pack.json",
+		"https://[::1]/pack.json",
+		"https://100.64.0.1/pack.json",
+	} {
+		if _, err := fetchTriviaPack(url); err == nil || !strings.Contains(err.Error(), "isn't a public address") {
+			t.Errorf("fetching %s = %v", url, err)
+		}
+	}
+	if _, err := fetchTriviaPack("http://example.com/pack.json"); err == nil {
+		t.Error("fetched a pack over plain http")
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	if got := truncateMessage("short"); got != "short" {
+		t.Errorf("truncateMessage(short) = %q", got)
+	}
+	// Every rune is two bytes, so an even cut would split the rune straddling the limit.
+	long := strings.Repeat("é", maxMessageLength)
+	got := truncateMessage(long)
+	if len(got) > maxMessageLength || !utf8.ValidString(got) || !strings.HasSuffix(got, "...") {
+		t.Errorf("truncateMessage cut to %d bytes, valid %v: %q", len(got), utf8.ValidString(got), got[len(got)-8:])
+	}
+}
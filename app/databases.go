@@ -6,10 +6,8 @@ import (
 	"fmt"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 
-	_ "github.com/lib/pq"
 	"go.uber.org/zap"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,8 +15,6 @@ import (
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
-const dbType = "postgres"
-
 // BOTDB is a global variable to hold the bot db connection since it's used all over
 var BOTDB *sql.DB
 
@@ -43,10 +39,20 @@ func getAWSSecret(secretName, region string) string {
 	result, err := svc.GetSecretValue(input)
 	if err != nil {
 		handleAWSError(err)
+		return ""
 	}
 	return *result.SecretString
 }
 
+// getSecret reads a secret from the environment when it's set there, as it is for local runs, and from
+// AWS Secrets Manager otherwise. The variable is the secret's name in capitals, so bot-oauth is BOT_OAUTH.
+func getSecret(secretName, region string) string {
+	if value, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(secretName, "-", "_"))); ok {
+		return value
+	}
+	return getAWSSecret(secretName, region)
+}
+
 /* DB Functions */
 
 func handleSQLError(err error) {
@@ -54,7 +60,16 @@ func handleSQLError(err error) {
 }
 
 func DBConnect(dbEndpoint, dbUser, dbPassword, dbName, dbType string) (*sql.DB, error) {
+	return dbConnect(dbEndpoint, dbUser, dbPassword, dbName, dbType, nil)
+}
+
+// dbConnect is DBConnect with extra connection parameters, which lib/pq sends on as run-time settings.
+func dbConnect(dbEndpoint, dbUser, dbPassword, dbName, dbType string, params url.Values) (*sql.DB, error) {
 	zap.S().Infof("Creating a DB Connection")
+	return sql.Open(dbType, dbURL(dbEndpoint, dbUser, dbPassword, dbName, params))
+}
+
+func dbURL(dbEndpoint, dbUser, dbPassword, dbName string, params url.Values) string {
 	dsn := fmt.Sprintf("postgres://%v/%v?sslmode=disable",
 		dbEndpoint,
 		dbName)
@@ -64,315 +79,229 @@ func DBConnect(dbEndpoint, dbUser, dbPassword, dbName, dbType string) (*sql.DB,
 		fmt.Printf("ERROR: %v\n", err)
 		panic(1)
 	}
+	if len(params) > 0 {
+		query := u.Query()
+		for key, values := range params {
+			query[key] = values
+		}
+		u.RawQuery = query.Encode()
+	}
 
 	zap.S().Infof("DB Url (no user): %v", u.String())
 
 	u.User = url.UserPassword(dbUser, dbPassword)
-	db, err := sql.Open(dbType, u.String())
+	return u.String()
+}
 
-	return db, err
+// WithTx runs fn inside a transaction, committing only if fn succeeds.
+// Every points balance change goes through here so games can't double-spend.
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 /* Bot DB */
 
+// BotDBPrepare opens the store, and the bot DB inside it.
 func BotDBPrepare() {
 	zap.S().Infof("Preparing the bot DB")
-	awsRegion := os.Getenv("AWS_REGION")
-	endpoint := getAWSSecret("db-endpoint", awsRegion)
-	dbUser := getAWSSecret("db-user", awsRegion)
-	dbPassword := getAWSSecret("db-password", awsRegion)
-	dbName := getAWSSecret("db-name", awsRegion)
-
-	db, err := DBConnect(endpoint, dbUser, dbPassword, dbName, dbType)
+	store, err := StoreOpen()
 	if err != nil {
-		handleSQLError(err)
+		zap.S().Fatalf("Couldn't open the store: %v", err)
 	}
-
-	BOTDB = db
-}
-
-func BotDBMainTablesPrepare() {
-	zap.S().Info("Preparing the bot DB broadcasters table")
-	statement, err := BOTDB.Prepare("CREATE TABLE IF NOT EXISTS broadcasters (id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY, channelname TEXT UNIQUE, dbcreated BOOL, authorized BOOL);")
-	if err != nil {
-		handleSQLError(err)
+	if err := MigrateOnConnect(store.DB(), store.MigrationSet(), "the bot DB"); err != nil {
+		zap.S().Fatalf("Couldn't migrate the bot DB: %v", err)
 	}
-	statement.Exec()
+	STORE = store
+	BOTDB = store.DB()
 }
 
 func BotDBBroadcasterList() string {
 	zap.S().Info("Listing broadcasters")
-	rows, err := BOTDB.Query("SELECT channelname FROM broadcasters WHERE dbcreated=true")
+	names, err := STORE.Broadcasters()
 	if err != nil {
 		handleSQLError(err)
 	}
-	defer rows.Close()
-
-	var result string
-	for rows.Next() {
-		var (
-			channelName string
-		)
-		if err := rows.Scan(&channelName); err != nil {
-			handleSQLError(err)
-		}
-		result += channelName + ";"
-	}
-
-	result = strings.TrimRight(result, ";")
-	return result
+	return strings.Join(names, ";")
 }
 
 func BotDBBroadcasterAdd(broadcaster string) {
 	zap.S().Info("Adding a new broadcaster")
-	insertStatement := "INSERT INTO broadcasters (channelname, dbcreated, authorized) VALUES ('" + broadcaster + "', false, false) ON CONFLICT (channelname) DO NOTHING;"
-
-	statement, err := BOTDB.Prepare(insertStatement)
-	if err != nil {
+	broadcaster = strings.ToLower(broadcaster)
+	if err := STORE.BroadcasterAdd(broadcaster); err != nil {
 		handleSQLError(err)
+		return
 	}
-	defer statement.Close()
-	statement.Exec()
 
 	zap.S().Infof("Checking if %v is new / has a DB already", broadcaster)
-	rows, err := BOTDB.Query("SELECT dbcreated, authorized FROM broadcasters WHERE channelname='" + broadcaster + "';")
+	dbcreated, authorized, err := STORE.Broadcaster(broadcaster)
 	if err != nil {
 		handleSQLError(err)
+		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var (
-			dbcreated  bool
-			authorized bool
-		)
-		if err := rows.Scan(&dbcreated, &authorized); err != nil {
+	if !dbcreated && authorized {
+		zap.S().Infof("dbcreated for %v is false and user is authorized", broadcaster)
+		if err := ChannelDBPrepare(broadcaster); err != nil {
 			handleSQLError(err)
+			return
 		}
-		if dbcreated == false && authorized == true {
-			zap.S().Infof("dbcreated for %v is false and user is authorized", broadcaster)
-			ChannelDBPrepare(broadcaster)
-			stmnt, err := BOTDB.Prepare("UPDATE broadcasters SET dbcreated = true WHERE channelname = '" + broadcaster + "';")
-			if err != nil {
-				handleSQLError(err)
-			}
-			stmnt.Exec()
-			zap.S().Infof("%v dbcreated set to true", broadcaster)
+		if err := STORE.BroadcasterCreated(broadcaster); err != nil {
+			handleSQLError(err)
+			return
 		}
+		zap.S().Infof("%v dbcreated set to true", broadcaster)
 	}
 }
 
 func BroadcasterAuthorize(broadcaster string) {
 	zap.S().Infof("Authorizing %v", broadcaster)
-	authorizeStatement, err := BOTDB.Prepare("UPDATE broadcasters SET authorized = true WHERE channelname = '" + broadcaster + "';")
-	if err != nil {
+	if err := STORE.BroadcasterAuthorize(strings.ToLower(strings.TrimSpace(broadcaster))); err != nil {
 		handleSQLError(err)
+		return
 	}
-	authorizeStatement.Exec()
 	zap.S().Infof("%v authorized", broadcaster)
 }
 
 func BotDBBroadcasterRemove(broadcaster string) {
 	zap.S().Info("Removing a broadcaster")
-	deleteStatement := "DELETE FROM broadcasters WHERE channelname = '" + broadcaster + "';"
-
-	statement, err := BOTDB.Prepare(deleteStatement)
-	if err != nil {
+	if err := STORE.BroadcasterRemove(strings.ToLower(broadcaster)); err != nil {
 		handleSQLError(err)
 	}
-	defer statement.Close()
-	statement.Exec()
 }
 
 /* Channel DB */
 
-func ChannelDBPrepare(channelName string) {
+func ChannelDBPrepare(channelName string) error {
 	zap.S().Infof("Preparing the %v channel DB", channelName)
-	awsRegion := os.Getenv("AWS_REGION")
-	dbUser := getAWSSecret("db-user", awsRegion)
-	dbEndpoint := getAWSSecret("db-endpoint", awsRegion)
-	dbPassword := getAWSSecret("db-password", awsRegion)
-	command := fmt.Sprintf("CREATE DATABASE %s;", channelName)
-	statement, err := BOTDB.Prepare(command)
-	if err != nil {
-		handleSQLError(err)
-	}
-	statement.Exec()
-
-	zap.S().Info("Creating new DB conenction")
-	database, err := DBConnect(dbEndpoint, dbUser, dbPassword, channelName, dbType)
-	if err != nil {
-		handleSQLError(err)
-	}
-	defer database.Close()
-
-	CommandTablePrepare(database)
-	UserTablePrepare(database)
-	QuoteTablePrepare(database)
+	return STORE.ChannelCreate(channelName)
 }
 
-func ChannelDBConnect(channelName string) *sql.DB {
-	awsRegion := os.Getenv("AWS_REGION")
-	dbUser := getAWSSecret("db-user", awsRegion)
-	dbEndpoint := getAWSSecret("db-endpoint", awsRegion)
-	dbPassword := getAWSSecret("db-password", awsRegion)
-
-	database, err := DBConnect(dbEndpoint, dbUser, dbPassword, channelName, dbType)
+// ChannelDBConnect opens the channel's storage, or returns nil after logging why it couldn't.
+func ChannelDBConnect(channelName string) ChannelStore {
+	st, err := STORE.Channel(channelName)
 	if err != nil {
 		handleSQLError(err)
+		return nil
 	}
-
-	return database
+	return st
 }
 
 /* Commands Table Interactions */
 
-func CommandTablePrepare(db *sql.DB) {
-	zap.S().Infof("Preparing the command table on a DB")
-	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS commands (id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY, trigger TEXT UNIQUE, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER);")
-	if err != nil {
-		handleSQLError(err)
-	}
-	defer statement.Close()
-	statement.Exec()
+// command is a single row of a channel's commands table.
+type command struct {
+	trigger    string
+	payload    string
+	permission string
+	cooldown   int
+	cost       int
 }
 
-func GetCommands(db *sql.DB) []string {
+func GetCommands(st ChannelStore) []string {
 	zap.S().Infof("Preparing a slice of commands in the DB")
-	statement := "SELECT DISTINCT trigger FROM commands;"
-	rows, err := db.Query(statement)
+	commands, err := st.CommandTriggers()
 	if err != nil {
 		handleSQLError(err)
 	}
-	defer rows.Close()
-
-	var commands []string
-	for rows.Next() {
-		var trigger string
-		rows.Scan(&trigger)
-		commands = append(commands, trigger)
-	}
-
 	return commands
 }
 
-func CommandDBSelect(trigger string, db *sql.DB) (string, string) {
+func CommandDBSelect(trigger string, st ChannelStore) command {
 	zap.S().Debugf("Querying database for command command: %v", trigger)
-	selectStatement := "SELECT payload, permission FROM commands WHERE trigger = '" + trigger + "';"
-
-	rows, err := db.Query(selectStatement)
+	comm, err := st.Command(trigger)
 	if err != nil {
-		handleSQLError(err)
-	}
-	defer rows.Close()
-
-	var payloadResult string
-	var permissionResult string
-	for rows.Next() {
-		var (
-			payload    string
-			permission string
-		)
-		rows.Scan(&payload, &permission)
-		zap.S().Debugf("Query result: payload: %v, permission: %v", payload, permission)
-		payloadResult = payload
-		permissionResult = permission
+		if err != sql.ErrNoRows {
+			handleSQLError(err)
+		}
+		return command{}
 	}
-
-	return payloadResult, permissionResult
+	zap.S().Debugf("Query result: payload: %v, permission: %v, cooldown: %v, cost: %v", comm.payload, comm.permission, comm.cooldown, comm.cost)
+	return comm
 }
 
-func CommandDBInsert(trigger string, payload string, permission string, cooldown int, db *sql.DB) string {
+func CommandDBInsert(trigger string, payload string, permission string, cooldown int, cost int, st ChannelStore) string {
 	zap.S().Info("Adding a command")
-	commandString := fmt.Sprintf("INSERT INTO commands (trigger, payload, permission, cooldown) VALUES ('%v', '%v', '%v', %v);", trigger, payload, permission, cooldown)
-	statement, err := db.Prepare(commandString)
-	if err != nil {
+	comm := command{trigger: trigger, payload: payload, permission: permission, cooldown: cooldown, cost: cost}
+	if err := st.CommandInsert(comm); err != nil {
 		handleSQLError(err)
 		return "I couldn't add that command due to a SQL error."
 	}
-	defer statement.Close()
-	statement.Exec()
 
 	return "Command " + trigger + " added succesfully."
 }
 
-func CommandDBRemove(trigger string, db *sql.DB) string {
+// CommandDBUpdate overwrites an existing command's payload, permission, cooldown and cost.
+func CommandDBUpdate(comm command, st ChannelStore) string {
+	zap.S().Info("Editing a command")
+	found, err := st.CommandUpdate(comm)
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't edit that command due to a SQL error."
+	}
+	if !found {
+		return "There's no command called " + comm.trigger + "."
+	}
+
+	return "Command " + comm.trigger + " edited succesfully."
+}
+
+func CommandDBRemove(trigger string, st ChannelStore) string {
 	zap.S().Info("Removing a command")
-	statement, err := db.Prepare("DELETE FROM commands WHERE trigger = '" + trigger + "';")
+	found, err := st.CommandRemove(trigger)
 	if err != nil {
-		panic(err)
+		handleSQLError(err)
+		return "I couldn't remove that command due to a SQL error."
+	}
+	if !found {
+		return "There's no command called " + trigger + "."
 	}
-	defer statement.Close()
-	statement.Exec()
 
 	return "Command " + trigger + " removed succesfully."
 }
 
 /* User/Viewer Table */
 
-func UserTablePrepare(db *sql.DB) {
-	zap.S().Info("Preparing the User Table for a channel")
-	// User table fields: Name, aliases, streams visited, last seen, watchtime, status, streamer BOOL, streamlink/shoutout
-	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS channelusers (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT, aliases BLOB, lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT)")
+// UserTableSelect looks a chatter up, reporting whether they've been seen before.
+func UserTableSelect(name string, st ChannelStore) (channelUser, bool) {
+	zap.S().Debugf("Selecting %v from the user DB", name)
+	u, err := st.User(name)
 	if err != nil {
-		panic(err)
+		if err != sql.ErrNoRows {
+			handleSQLError(err)
+		}
+		return channelUser{}, false
 	}
-	defer statement.Close()
-	statement.Exec()
+	return u, true
 }
 
-func UserTableSelect(db *sql.DB) {
-	zap.S().Info("Selecting from the user DB")
-	fmt.Printf("%v\n", db)
-}
-
-func UserTableInsert(db *sql.DB) {
-	zap.S().Info("Inserting into the User DB")
-	fmt.Printf("%v\n", db)
+func UserTableInsert(u channelUser, st ChannelStore) {
+	zap.S().Debugf("Inserting %v into the User DB", u.name)
+	if err := st.UserAdd(u); err != nil {
+		handleSQLError(err)
+	}
 }
 
 /* Quote Table */
 
-func QuoteTablePrepare(db *sql.DB) {
-	zap.S().Info("Preparing the Quote Table for a channel")
-	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS quotes (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, quote TEXT, addedby TEXT)")
-	if err != nil {
-		panic(err)
-	}
-	defer statement.Close()
-	statement.Exec()
-}
-
-func QuoteTableSelect(quoteNumber int, db *sql.DB) (string, int, string) {
-	zap.S().Debugf("Querying database for command command: %v", quoteNumber)
+func QuoteTableSelect(quoteNumber int, st ChannelStore) (string, int, string) {
+	zap.S().Debugf("Querying database for quote: %v", quoteNumber)
 	if quoteNumber < 0 {
 		return "", 0, ""
 	}
-	if quoteNumber == 0 {
-		quoteNumber = 0
-	}
-	selectStatement := "SELECT * FROM quotes WHERE id = '" + strconv.Itoa(quoteNumber) + "';"
-
-	rows, err := db.Query(selectStatement)
+	q, err := st.Quote(quoteNumber)
 	if err != nil {
-		panic(err)
-	}
-	defer rows.Close()
-
-	var quoteBody string
-	var addedBy string
-
-	for rows.Next() {
-		var (
-			quoteText string
-			adder     string
-			quoteNum  int
-		)
-		rows.Scan(&quoteText, &adder, &quoteNum)
-		zap.S().Debugf("Query result: quoteNum: %v, quoteText: %v, adder: %v", quoteNum, quoteText, adder)
-		quoteBody = quoteText
-		quoteNumber = quoteNum
-		addedBy = adder
+		if err != sql.ErrNoRows {
+			handleSQLError(err)
+		}
+		return "", quoteNumber, ""
 	}
-
-	return quoteBody, quoteNumber, addedBy
+	zap.S().Debugf("Query result: quoteNum: %v, quoteText: %v, adder: %v", q.id, q.text, q.addedBy)
+	return q.text, q.id, q.addedBy
 }
@@ -1,2 +1,364 @@
 // Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
 package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// hostileInputs seed the fuzzers with the strings that broke the old concatenated queries.
+var hostileInputs = []string{
+	"",
+	"hello",
+	"it's",
+	"'; DROP TABLE commands; --",
+	"Robert'); DROP TABLE broadcasters;--",
+	"' OR '1'='1",
+	`\'; SELECT pg_sleep(10); --`,
+	"$1",
+	"%s %v {user}",
+	"\"quoted\"",
+	"emoji 🎉 and ünïcödé",
+}
+
+// testDB opens a private in-memory database with the original channel and bot tables.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	schema := []string{
+		"CREATE TABLE commands (id INTEGER PRIMARY KEY, trigger TEXT UNIQUE, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER, cost INTEGER DEFAULT 0)",
+		"CREATE TABLE quotes (id INTEGER PRIMARY KEY, quote TEXT, addedby TEXT)",
+		"CREATE TABLE broadcasters (id INTEGER PRIMARY KEY, channelname TEXT UNIQUE, dbcreated BOOL, authorized BOOL)",
+	}
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testSQLiteStore opens a migrated SQLite store in memory.
+func testSQLiteStore(t *testing.T) Store {
+	t.Helper()
+	store, err := sqliteStoreOpen(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	if _, err := Migrate(store.DB(), store.MigrationSet(), -1); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testChannel adds the broadcaster to the store and opens its channel.
+func testChannel(t *testing.T, store Store, name string) ChannelStore {
+	t.Helper()
+	if err := store.BroadcasterAdd(name); err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.Channel(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// testStores opens both channel stores over fresh in-memory databases, so every fuzzer checks each backend.
+func testStores(t *testing.T) map[string]ChannelStore {
+	t.Helper()
+	sqlite := testChannel(t, testSQLiteStore(t), "hikthur")
+	return map[string]ChannelStore{"repository": ChannelRepository{testDB(t)}, "sqlite": sqlite}
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("%s is gone: %v", table, err)
+	}
+	return n
+}
+
+func FuzzCommandRoundTrip(f *testing.F) {
+	for _, trigger := range hostileInputs {
+		for _, payload := range hostileInputs {
+			f.Add(trigger, payload, "m", 30, 5)
+		}
+	}
+	f.Fuzz(func(t *testing.T, trigger, payload, permission string, cooldown, cost int) {
+		for name, st := range testStores(t) {
+			want := command{trigger: trigger, payload: payload, permission: permission, cooldown: cooldown, cost: cost}
+
+			CommandDBInsert(trigger, payload, permission, cooldown, cost, st)
+			if got := CommandDBSelect(trigger, st); got != want {
+				t.Fatalf("%s: round trip changed the command: got %+v, want %+v", name, got, want)
+			}
+			if triggers := GetCommands(st); len(triggers) != 1 || triggers[0] != trigger {
+				t.Fatalf("%s: GetCommands = %q, want [%q]", name, triggers, trigger)
+			}
+
+			want.payload = payload + payload
+			CommandDBUpdate(want, st)
+			if got := CommandDBSelect(trigger, st); got != want {
+				t.Fatalf("%s: edit changed the command: got %+v, want %+v", name, got, want)
+			}
+
+			CommandDBRemove(trigger, st)
+			if n := countRows(t, st.DB(), "commands"); n != 0 {
+				t.Fatalf("%s: %d commands left after removing the only one", name, n)
+			}
+			countRows(t, st.DB(), "quotes")
+		}
+	})
+}
+
+func FuzzCommandLookupIsExact(f *testing.F) {
+	for _, trigger := range hostileInputs {
+		f.Add(trigger)
+	}
+	f.Fuzz(func(t *testing.T, probe string) {
+		for name, st := range testStores(t) {
+			CommandDBInsert("secret", "payload", "b", 0, 0, st)
+			got := CommandDBSelect(probe, st)
+			if probe != "secret" && got != (command{}) {
+				t.Fatalf("%s: looking up %q found %+v", name, probe, got)
+			}
+			if n := countRows(t, st.DB(), "commands"); n != 1 {
+				t.Fatalf("%s: looking up %q left %d commands", name, probe, n)
+			}
+		}
+	})
+}
+
+func FuzzBroadcasterAdd(f *testing.F) {
+	for _, name := range hostileInputs {
+		f.Add(name)
+	}
+	f.Add("hikthur")
+	f.Fuzz(func(t *testing.T, name string) {
+		db := testDB(t)
+		repo := BotRepository{db}
+		err := repo.BroadcasterAdd(name)
+		if !ValidChannelName(name) {
+			if err != errBadChannelName {
+				t.Fatalf("BroadcasterAdd(%q) = %v, want errBadChannelName", name, err)
+			}
+			if n := countRows(t, db, "broadcasters"); n != 0 {
+				t.Fatalf("invalid name %q was stored", name)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.BroadcasterAuthorize(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.BroadcasterCreated(name); err != nil {
+			t.Fatal(err)
+		}
+		if created, authorized, err := repo.Broadcaster(name); err != nil || !created || !authorized {
+			t.Fatalf("Broadcaster(%q) = %v, %v, %v", name, created, authorized, err)
+		}
+		if names, err := repo.Broadcasters(); err != nil || len(names) != 1 || names[0] != name {
+			t.Fatalf("Broadcasters() = %q, %v", names, err)
+		}
+		if err := repo.BroadcasterRemove(name); err != nil {
+			t.Fatal(err)
+		}
+		if n := countRows(t, db, "broadcasters"); n != 0 {
+			t.Fatalf("%d broadcasters left after removing %q", n, name)
+		}
+	})
+}
+
+func FuzzQuoteLookup(f *testing.F) {
+	f.Add(1)
+	f.Add(-1)
+	f.Add(0)
+	f.Fuzz(func(t *testing.T, n int) {
+		for name, st := range testStores(t) {
+			var err error
+			if repo, ok := st.(ChannelRepository); ok {
+				// The test SQLite is too old for the RETURNING the Postgres insert uses.
+				_, err = repo.db.Exec("INSERT INTO quotes (quote, addedby) VALUES ($1, $2)", "it's a quote", "o'brien")
+			} else {
+				_, err = st.QuoteAdd("it's a quote", "o'brien")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, id, addedBy := QuoteTableSelect(n, st)
+			if n == 1 && (text != "it's a quote" || id != 1 || addedBy != "o'brien") {
+				t.Fatalf("%s: QuoteTableSelect(1) = %q, %d, %q", name, text, id, addedBy)
+			}
+			if n != 1 && (text != "" || addedBy != "") {
+				t.Fatalf("%s: QuoteTableSelect(%d) found %q", name, n, text)
+			}
+		}
+	})
+}
+
+func TestSQLiteChannelsAreSeparate(t *testing.T) {
+	store := testSQLiteStore(t)
+	first := testChannel(t, store, "first")
+	second := testChannel(t, store, "second")
+
+	CommandDBInsert("hello", "hi from first", "e", 0, 0, first)
+	CommandDBInsert("hello", "hi from second", "e", 0, 0, second)
+	CommandDBRemove("hello", second)
+	if got := CommandDBSelect("hello", first); got.payload != "hi from first" {
+		t.Fatalf("first's command is %+v after second removed its own", got)
+	}
+	if triggers := GetCommands(second); len(triggers) != 0 {
+		t.Fatalf("second still has %q", triggers)
+	}
+
+	first.QuoteAdd("first quote", "a")
+	if id, _ := second.QuoteAdd("second quote", "b"); id != 1 {
+		t.Fatalf("second's first quote is #%d", id)
+	}
+	UserTableInsert(channelUser{name: "viewer"}, first)
+	if _, seen := UserTableSelect("viewer", second); seen {
+		t.Fatal("second sees a chatter who only spoke in first")
+	}
+	if _, err := store.Channel("Robert'); DROP TABLE commands;--"); err != errBadChannelName {
+		t.Fatalf("a bad channel name opened a store: %v", err)
+	}
+	if _, err := store.Channel("stranger"); err == nil {
+		t.Fatal("a channel that isn't a broadcaster opened a store")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	for _, set := range []string{"postgres/bot", "postgres/channel", "postgres/features", "sqlite"} {
+		if _, err := loadMigrations(set); err != nil {
+			t.Errorf("%s: %v", set, err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	migrations, _ := loadMigrations("sqlite")
+	for _, step := range []struct{ target, want int }{{-1, len(migrations)}, {-1, len(migrations)}, {0, 0}, {-1, len(migrations)}} {
+		version, err := Migrate(db, "sqlite", step.target)
+		if err != nil || version != step.want {
+			t.Fatalf("Migrate to %d = %d, %v; want %d", step.target, version, err, step.want)
+		}
+		if stored, _ := SchemaVersion(db, "sqlite"); stored != version {
+			t.Fatalf("schema_version says %d after migrating to %d", stored, version)
+		}
+	}
+	countRows(t, db, "commands")
+
+	// Rows written before channel_id existed follow their channel through the migration.
+	if _, err := Migrate(db, "sqlite", 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"INSERT INTO broadcasters (channelname) VALUES ('hikthur')",
+		"INSERT INTO commands (channel, trigger, payload) VALUES ('hikthur', 'hello', 'hi')",
+		"INSERT INTO quotes (channel, id, quote) VALUES ('hikthur', 3, 'three')",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Migrate(db, "sqlite", -1); err != nil {
+		t.Fatal(err)
+	}
+	st, err := sqliteStore{BotRepository{db}}.Channel("hikthur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comm, err := st.Command("hello"); err != nil || comm.payload != "hi" {
+		t.Fatalf("hello after migrating = %+v, %v", comm, err)
+	}
+	if q, err := st.Quote(3); err != nil || q.text != "three" {
+		t.Fatalf("quote 3 after migrating = %+v, %v", q, err)
+	}
+
+	if _, err := db.Exec("INSERT INTO schema_version (version, name) VALUES (99, 'future')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(db, "sqlite", -1); err == nil {
+		t.Fatal("migrated a database newer than the migrations")
+	}
+
+	// Below the baseline, the downs would drop tables the migrations only adopted. Nothing runs.
+	if _, err := db.Exec("DELETE FROM schema_version WHERE version = 99"); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Migrate(db, "postgres/channel", 1); err == nil || version != 2 {
+		t.Fatalf("Migrate below the baseline = %d, %v; want a refusal at 2", version, err)
+	}
+}
+
+func TestChannelArchive(t *testing.T) {
+	store := testSQLiteStore(t)
+	from := testChannel(t, store, "first")
+	CommandDBInsert("hello", "hi {user}", "e", 5, 0, from)
+	CommandDBInsert("lurk", "enjoy the lurk", "e", 0, 10, from)
+	from.QuoteAdd("first quote", "a")
+	from.QuoteAdd("second quote", "b")
+	UserTableInsert(channelUser{name: "viewer", streamsVisited: 3, streamLink: "twitch.tv/viewer"}, from)
+
+	archive, err := ChannelExport("first", from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive = channelArchive{}
+	if err := json.Unmarshal(body, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// A !removecommand spree, and an edit made since the export that restoring mustn't undo.
+	CommandDBRemove("lurk", from)
+	CommandDBUpdate(command{"hello", "hello again", "e", 5, 0}, from)
+	summary, err := ChannelRestore(archive, from)
+	if err != nil || !strings.HasPrefix(summary, "1 of 2 commands") {
+		t.Fatalf("restoring over first = %q, %v", summary, err)
+	}
+	if got := CommandDBSelect("lurk", from); got.cost != 10 {
+		t.Fatalf("lurk after restoring is %+v", got)
+	}
+	if got := CommandDBSelect("hello", from); got.payload != "hello again" {
+		t.Fatalf("restoring undid an edit: hello is %+v", got)
+	}
+	if quotes, _ := from.Quotes(); len(quotes) != 2 {
+		t.Fatalf("restoring over first left %d quotes", len(quotes))
+	}
+
+	to := testChannel(t, store, "second")
+	if _, err := ChannelRestore(archive, to); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := to.Quote(2); err != nil || q.text != "second quote" {
+		t.Fatalf("quote 2 in second = %+v, %v", q, err)
+	}
+	if u, seen := UserTableSelect("viewer", to); !seen || u.streamsVisited != 3 || u.streamLink != "twitch.tv/viewer" {
+		t.Fatalf("viewer in second = %+v, %v", u, seen)
+	}
+
+	archive.Version = archiveVersion + 1
+	if _, err := ChannelRestore(archive, to); err == nil {
+		t.Fatal("restored an archive newer than the bot")
+	}
+}
@@ -0,0 +1,151 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// EventSub reports what IRC no longer does: why a mod banned someone, and unbans at all. The bot keeps one
+// WebSocket session and subscribes it to every joined channel's bans and unbans, using its own token. That
+// needs the channel:moderate scope, and only works in channels where the bot is a mod.
+
+const eventSubURL = "wss://eventsub.wss.twitch.tv/ws"
+
+// errEventSubUnused means no channel could be subscribed to, so there's no point keeping a session open.
+var errEventSubUnused = errors.New("no channel's bans could be subscribed to")
+
+type eventSubMessage struct {
+	Metadata struct {
+		MessageType      string `json:"message_type"`
+		SubscriptionType string `json:"subscription_type"`
+	} `json:"metadata"`
+	Payload struct {
+		Session struct {
+			ID                      string `json:"id"`
+			KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+			ReconnectURL            string `json:"reconnect_url"`
+		} `json:"session"`
+		Event eventSubBan `json:"event"`
+	} `json:"payload"`
+}
+
+// eventSubBan is the event in a channel.ban or channel.unban notification. Unbans have no reason.
+type eventSubBan struct {
+	UserLogin            string `json:"user_login"`
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	ModeratorUserLogin   string `json:"moderator_user_login"`
+	Reason               string `json:"reason"`
+	IsPermanent          bool   `json:"is_permanent"`
+}
+
+// eventSubSubscribe asks for the channel's bans and unbans on the session.
+func eventSubSubscribe(sessionID string, ch broadcaster) error {
+	id, err := HelixUserID(ch.name)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("twitch doesn't know %s", ch.name)
+	}
+	for _, kind := range []string{"channel.ban", "channel.unban"} {
+		body := map[string]interface{}{
+			"type":      kind,
+			"version":   "1",
+			"condition": map[string]string{"broadcaster_user_id": id},
+			"transport": map[string]string{"method": "websocket", "session_id": sessionID},
+		}
+		var created struct{}
+		if err := helixModeratorPost("/eventsub/subscriptions", body, &created); err != nil {
+			return fmt.Errorf("%s: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// eventSubSession reads one connection until it fails or Twitch moves the session elsewhere. It returns the
+// URL to move to, where the session's subscriptions carry on, or "" when a new session has to be started.
+func eventSubSession(url string, subscribe bool) (string, error) {
+	conn, err := websocket.Dial(url, "", "https://localhost/")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// Twitch sends something at least every keepalive interval, so a longer silence means the connection is gone.
+	keepalive := 30 * time.Second
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepalive + 10*time.Second))
+		var message eventSubMessage
+		if err := websocket.JSON.Receive(conn, &message); err != nil {
+			return "", err
+		}
+		switch message.Metadata.MessageType {
+		case "session_welcome":
+			if seconds := message.Payload.Session.KeepaliveTimeoutSeconds; seconds > 0 {
+				keepalive = time.Duration(seconds) * time.Second
+			}
+			if !subscribe {
+				continue
+			}
+			subscribed := 0
+			for _, ch := range channels {
+				if ch.database == nil {
+					continue
+				}
+				if err := eventSubSubscribe(message.Payload.Session.ID, ch); err != nil {
+					zap.S().Errorf("Couldn't follow bans in %v: %v", ch.name, err)
+					continue
+				}
+				subscribed++
+			}
+			if subscribed == 0 {
+				return "", errEventSubUnused
+			}
+		case "session_reconnect":
+			return message.Payload.Session.ReconnectURL, nil
+		case "notification":
+			eventSubNotify(message.Metadata.SubscriptionType, message.Payload.Event)
+		case "revocation":
+			zap.S().Warnf("Twitch stopped sending %v, usually because the bot lost its mod role or scope", message.Metadata.SubscriptionType)
+		}
+	}
+}
+
+func eventSubNotify(kind string, event eventSubBan) {
+	ch, ok := channels[event.BroadcasterUserLogin]
+	if !ok {
+		return
+	}
+	switch kind {
+	case "channel.ban":
+		if event.IsPermanent {
+			SharedBanObserve(event.UserLogin, event.Reason, event.ModeratorUserLogin, ch)
+		}
+	case "channel.unban":
+		SharedBanUnbanObserve(event.UserLogin, event.ModeratorUserLogin, ch)
+	}
+}
+
+// EventSubListen follows bans and unbans until the bot exits, starting a new session whenever one is lost.
+func EventSubListen() {
+	url, subscribe := eventSubURL, true
+	for {
+		next, err := eventSubSession(url, subscribe)
+		if next != "" {
+			url, subscribe = next, false
+			continue
+		}
+		if err == errEventSubUnused {
+			zap.S().Warn("Not following bans over EventSub, so shared bans only come from !sharedban")
+			return
+		}
+		zap.S().Errorf("Lost the EventSub connection, starting again: %v", err)
+		time.Sleep(10 * time.Second)
+		url, subscribe = eventSubURL, true
+	}
+}
@@ -0,0 +1,362 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A channel's export is one JSON archive of everything a streamer would miss: commands, quotes, users, points,
+// settings, regulars, the blocklist, name rules and the channel's trivia questions. History is left out: the
+// modlog, strikes, chat log and finished giveaways, polls and predictions stay with the deployment. Restoring adds what's missing and leaves rows that are already there alone, so an archive can
+// undo a !removecommand spree without undoing the edits made since, and a restore can be run again safely.
+// Archives carry no channel ids, so they restore into any channel, on any store, in any deployment.
+
+// archiveVersion is bumped whenever the archive's shape changes. Restore refuses archives newer than it.
+// Version 2 added regulars, the blocklist, name rules and trivia.
+const archiveVersion = 2
+
+type channelArchive struct {
+	Version   int               `json:"version"`
+	Channel   string            `json:"channel"`
+	Exported  time.Time         `json:"exported"`
+	Commands  []archiveCommand  `json:"commands"`
+	Quotes    []archiveQuote    `json:"quotes"`
+	Users     []archiveUser     `json:"users"`
+	Points    []archivePoints   `json:"points"`
+	Settings  map[string]string `json:"settings"`
+	Regulars  []archiveRegular  `json:"regulars"`
+	Blocklist []archiveRule     `json:"blocklist"`
+	NameRules []archiveRule     `json:"name_rules"`
+	Trivia    []archiveTrivia   `json:"trivia"`
+}
+
+type archiveCommand struct {
+	Trigger    string `json:"trigger"`
+	Payload    string `json:"payload"`
+	Permission string `json:"permission"`
+	Cooldown   int    `json:"cooldown"`
+	Cost       int    `json:"cost"`
+}
+
+type archiveQuote struct {
+	ID      int    `json:"id"`
+	Text    string `json:"text"`
+	AddedBy string `json:"added_by"`
+}
+
+type archiveUser struct {
+	Name           string `json:"name"`
+	LastSeen       string `json:"last_seen"`
+	StreamsVisited int    `json:"streams_visited"`
+	WatchTime      int    `json:"watch_time"`
+	Streamer       bool   `json:"streamer"`
+	StreamLink     string `json:"stream_link"`
+}
+
+type archivePoints struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+	Balance  int64  `json:"balance"`
+}
+
+type archiveRegular struct {
+	Name    string `json:"name"`
+	AddedBy string `json:"added_by"`
+}
+
+// archiveRule is a blocklist entry or a name rule, which have the same shape.
+type archiveRule struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	AddedBy string `json:"added_by"`
+}
+
+type archiveTrivia struct {
+	Category string   `json:"category"`
+	Question string   `json:"question"`
+	Answers  []string `json:"answers"`
+}
+
+/* Export */
+
+// ChannelExport reads everything the archive holds from the channel's store.
+func ChannelExport(channel string, st ChannelStore) (channelArchive, error) {
+	// Empty sections are written as [] and {}, not null, so the archive reads the same whatever the channel has.
+	archive := channelArchive{
+		Version:   archiveVersion,
+		Channel:   channel,
+		Exported:  time.Now().UTC(),
+		Commands:  []archiveCommand{},
+		Quotes:    []archiveQuote{},
+		Users:     []archiveUser{},
+		Points:    []archivePoints{},
+		Settings:  map[string]string{},
+		Regulars:  []archiveRegular{},
+		Blocklist: []archiveRule{},
+		NameRules: []archiveRule{},
+		Trivia:    []archiveTrivia{},
+	}
+
+	comms, err := st.Commands()
+	if err != nil {
+		return archive, err
+	}
+	for _, comm := range comms {
+		archive.Commands = append(archive.Commands, archiveCommand{comm.trigger, comm.payload, comm.permission, comm.cooldown, comm.cost})
+	}
+
+	quotes, err := st.Quotes()
+	if err != nil {
+		return archive, err
+	}
+	for _, q := range quotes {
+		archive.Quotes = append(archive.Quotes, archiveQuote{q.id, q.text, q.addedBy})
+	}
+
+	users, err := st.Users()
+	if err != nil {
+		return archive, err
+	}
+	for _, u := range users {
+		archive.Users = append(archive.Users, archiveUser{u.name, u.lastSeen, u.streamsVisited, u.watchTime, u.streamer, u.streamLink})
+	}
+
+	if featureDB(st) == nil {
+		return archive, nil
+	}
+	points, err := queryAll(st.DB(), func(row scanner) (archivePoints, error) {
+		var p archivePoints
+		err := row.Scan(&p.UserID, &p.UserName, &p.Balance)
+		return p, err
+	}, "SELECT userid, COALESCE(username, ''), balance FROM points ORDER BY userid;")
+	if err != nil {
+		return archive, err
+	}
+	archive.Points = append(archive.Points, points...)
+	settings, err := queryAll(st.DB(), func(row scanner) ([2]string, error) {
+		var setting [2]string
+		err := row.Scan(&setting[0], &setting[1])
+		return setting, err
+	}, "SELECT name, COALESCE(value, '') FROM settings ORDER BY name;")
+	if err != nil {
+		return archive, err
+	}
+	for _, setting := range settings {
+		archive.Settings[setting[0]] = setting[1]
+	}
+
+	regulars, err := queryAll(st.DB(), func(row scanner) (archiveRegular, error) {
+		var r archiveRegular
+		err := row.Scan(&r.Name, &r.AddedBy)
+		return r, err
+	}, "SELECT username, COALESCE(addedby, '') FROM regulars ORDER BY username;")
+	if err != nil {
+		return archive, err
+	}
+	archive.Regulars = append(archive.Regulars, regulars...)
+	scanRule := func(row scanner) (archiveRule, error) {
+		var r archiveRule
+		err := row.Scan(&r.Kind, &r.Pattern, &r.Action, &r.AddedBy)
+		return r, err
+	}
+	blocklist, err := queryAll(st.DB(), scanRule, "SELECT kind, pattern, action, COALESCE(addedby, '') FROM blocklist ORDER BY id;")
+	if err != nil {
+		return archive, err
+	}
+	archive.Blocklist = append(archive.Blocklist, blocklist...)
+	nameRules, err := queryAll(st.DB(), scanRule, "SELECT kind, pattern, action, COALESCE(addedby, '') FROM namerules ORDER BY id;")
+	if err != nil {
+		return archive, err
+	}
+	archive.NameRules = append(archive.NameRules, nameRules...)
+	trivia, err := queryAll(st.DB(), func(row scanner) (archiveTrivia, error) {
+		var (
+			t       archiveTrivia
+			answers string
+		)
+		err := row.Scan(&t.Category, &t.Question, &answers)
+		t.Answers = strings.Split(answers, "|")
+		return t, err
+	}, "SELECT COALESCE(category, ''), question, COALESCE(answers, '') FROM triviaquestions ORDER BY id;")
+	if err != nil {
+		return archive, err
+	}
+	archive.Trivia = append(archive.Trivia, trivia...)
+	return archive, nil
+}
+
+// ExportRun writes the channel's archive to w.
+func ExportRun(channel string, w io.Writer) error {
+	st, err := STORE.Channel(channel)
+	if err != nil {
+		return err
+	}
+	// The channel's tables are brought up to date first, as they are when the bot joins it.
+	st.Prepare()
+	archive, err := ChannelExport(channel, st)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(archive)
+}
+
+/* Restore */
+
+// check rejects archives this bot can't read.
+func (a channelArchive) check() error {
+	if a.Version < 1 || a.Version > archiveVersion {
+		return fmt.Errorf("the archive is version %d, and this bot reads versions 1 to %d", a.Version, archiveVersion)
+	}
+	return nil
+}
+
+// ChannelRestore adds the archive's rows that the channel doesn't have yet, and summarizes what it added.
+func ChannelRestore(archive channelArchive, st ChannelStore) (string, error) {
+	if err := archive.check(); err != nil {
+		return "", err
+	}
+
+	added := 0
+	for _, c := range archive.Commands {
+		if _, err := st.Command(c.Trigger); err == sql.ErrNoRows {
+			if err := st.CommandInsert(command{c.Trigger, c.Payload, c.Permission, c.Cooldown, c.Cost}); err != nil {
+				return "", err
+			}
+			added++
+		} else if err != nil {
+			return "", err
+		}
+	}
+	for _, u := range archive.Users {
+		if err := st.UserAdd(channelUser{u.Name, u.LastSeen, u.StreamsVisited, u.WatchTime, u.Streamer, u.StreamLink}); err != nil {
+			return "", err
+		}
+	}
+	// Quotes keep their numbers, since viewers ask for them by number.
+	for _, q := range archive.Quotes {
+		if err := st.QuoteImport(quote{q.ID, q.Text, q.AddedBy}); err != nil {
+			return "", err
+		}
+	}
+	summary := fmt.Sprintf("%d of %d commands, %d users, %d quotes", added, len(archive.Commands), len(archive.Users), len(archive.Quotes))
+
+	if featureDB(st) == nil {
+		if len(archive.Points) > 0 || len(archive.Settings) > 0 || len(archive.Regulars) > 0 || len(archive.Blocklist) > 0 || len(archive.NameRules) > 0 || len(archive.Trivia) > 0 {
+			summary += "; the channel features skipped, since a SQLite store doesn't keep them"
+		}
+		return summary, nil
+	}
+	// Rows the channel already has are skipped by ON CONFLICT, so only what was inserted is counted.
+	var points, settings, regulars, blocklist, nameRules int
+	insert := func(tx *sql.Tx, count *int, query string, args ...interface{}) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		*count += int(n)
+		return nil
+	}
+	err := WithTx(st.DB(), func(tx *sql.Tx) error {
+		for _, p := range archive.Points {
+			if err := insert(tx, &points, "INSERT INTO points (userid, username, balance) VALUES ($1, $2, $3) ON CONFLICT (userid) DO NOTHING;", p.UserID, p.UserName, p.Balance); err != nil {
+				return err
+			}
+		}
+		for name, value := range archive.Settings {
+			if err := insert(tx, &settings, "INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING;", name, value); err != nil {
+				return err
+			}
+		}
+		for _, r := range archive.Regulars {
+			if err := insert(tx, &regulars, "INSERT INTO regulars (username, addedby) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING;", r.Name, r.AddedBy); err != nil {
+				return err
+			}
+		}
+		for _, r := range archive.Blocklist {
+			if err := insert(tx, &blocklist, "INSERT INTO blocklist (kind, pattern, action, addedby) VALUES ($1, $2, $3, $4) ON CONFLICT (kind, pattern) DO NOTHING;", r.Kind, r.Pattern, r.Action, r.AddedBy); err != nil {
+				return err
+			}
+		}
+		for _, r := range archive.NameRules {
+			if err := insert(tx, &nameRules, "INSERT INTO namerules (kind, pattern, action, addedby) VALUES ($1, $2, $3, $4) ON CONFLICT (kind, pattern) DO NOTHING;", r.Kind, r.Pattern, r.Action, r.AddedBy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	questions := make([]triviaQuestion, 0, len(archive.Trivia))
+	for _, t := range archive.Trivia {
+		questions = append(questions, triviaQuestion{t.Category, t.Question, t.Answers})
+	}
+	trivia, err := TriviaImport(questions, st.DB())
+	if err != nil {
+		return "", err
+	}
+	return summary + fmt.Sprintf(", %d of %d point balances, %d of %d settings, %d of %d regulars, %d of %d blocklist entries, %d of %d name rules, %d of %d trivia questions",
+		points, len(archive.Points), settings, len(archive.Settings), regulars, len(archive.Regulars), blocklist, len(archive.Blocklist),
+		nameRules, len(archive.NameRules), trivia, len(archive.Trivia)), nil
+}
+
+// RestoreRun reads an archive from r into the channel, first adding the channel if this deployment doesn't have it.
+// A channel added this way still needs authorizing before the bot joins it.
+func RestoreRun(channel string, r io.Reader) error {
+	var archive channelArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return fmt.Errorf("reading the archive: %v", err)
+	}
+	// Checked before the channel is added, so a bad archive changes nothing.
+	if err := archive.check(); err != nil {
+		return err
+	}
+	channel = strings.ToLower(channel)
+
+	created, _, err := STORE.Broadcaster(channel)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !created {
+		if err := STORE.BroadcasterAdd(channel); err != nil {
+			return err
+		}
+		if err := STORE.ChannelCreate(channel); err != nil {
+			return err
+		}
+		if err := STORE.BroadcasterCreated(channel); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s; authorize it for the bot to join\n", channel)
+	}
+
+	st, err := STORE.Channel(channel)
+	if err != nil {
+		return err
+	}
+	// The channel's tables are brought up to date first, as they are when the bot joins it.
+	st.Prepare()
+	summary, err := ChannelRestore(archive, st)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", channel, summary)
+
+	// Running bots hold the channel's commands and settings in memory.
+	if _, ok := STORE.(cacheListener); ok {
+		cacheNotifyStart()
+		CacheNotify(channel, "command")
+		CacheNotify(channel, "settings")
+		CacheNotify(channel, "moderation")
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	for _, game := range []string{"duel", "gamble"} {
+		settingDefaults["games."+game+".enabled"] = "true"
+		settingDefaults["games."+game+".cooldown"] = "60"
+		settingDefaults["games."+game+".min"] = "10"
+		settingDefaults["games."+game+".max"] = "10000"
+	}
+	settingDefaults["games.duel.timeout"] = "60"
+	settingDefaults["games.gamble.winchance"] = "45"
+	settingDefaults["games.gamble.payout"] = "2"
+	settingValidators["games.gamble.payout"] = func(value string) string {
+		if payout, err := strconv.ParseFloat(value, 64); err != nil || payout <= 1 {
+			return "The payout multiplies the stake on a win, so it has to be more than 1."
+		}
+		return ""
+	}
+}
+
+type duel struct {
+	challengerID   string
+	challengerName string
+	targetName     string
+	amount         int64
+	timer          *time.Timer
+}
+
+var (
+	gamesMutex    sync.Mutex
+	gameCooldowns = make(map[string]time.Time)
+	// gamesPlaying holds the gambles whose stakes are still being settled, so a second can't start alongside.
+	gamesPlaying = make(map[string]bool)
+	duels        = make(map[string]map[string]*duel)
+)
+
+/* Helpers */
+
+// rollPercent returns a crypto-random number in [0, 100).
+func rollPercent() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(100))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64(), nil
+}
+
+// gameStake validates the amount against the game's switch and stake limits.
+// It returns a chat message when the stake isn't allowed.
+func gameStake(game, amount string, ch broadcaster) (int64, string) {
+	if !SettingGetBool("games."+game+".enabled", ch.database) {
+		return 0, fmt.Sprintf("!%s is turned off in this channel.", game)
+	}
+	stake, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || stake <= 0 {
+		return 0, fmt.Sprintf("That's not an amount of %s I understand.", SettingGet("points.name", ch.database))
+	}
+	minStake := int64(SettingGetInt("games."+game+".min", ch.database))
+	maxStake := int64(SettingGetInt("games."+game+".max", ch.database))
+	if stake < minStake || (maxStake > 0 && stake > maxStake) {
+		return 0, fmt.Sprintf("!%s stakes have to be between %d and %d.", game, minStake, maxStake)
+	}
+	return stake, ""
+}
+
+// gameOnCooldown reports whether the user played the game within its cooldown. Callers hold gamesMutex.
+func gameOnCooldown(game, userID string, ch broadcaster) bool {
+	cooldown := time.Duration(SettingGetInt("games."+game+".cooldown", ch.database)) * time.Second
+	last, ok := gameCooldowns[ch.name+"/"+game+"/"+userID]
+	return ok && time.Since(last) < cooldown
+}
+
+// gamePlayed starts the user's cooldown. Callers hold gamesMutex.
+func gamePlayed(game, userID string, ch broadcaster) {
+	gameCooldowns[ch.name+"/"+game+"/"+userID] = time.Now()
+}
+
+/* Gamble */
+
+func GambleCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	stake, problem := gameStake("gamble", strings.TrimSpace(options), ch)
+	if problem != "" {
+		return problem
+	}
+
+	// The cooldown only starts once the stake is settled, so a gamble that couldn't be paid for doesn't count.
+	key := ch.name + "/gamble/" + message.User.ID
+	gamesMutex.Lock()
+	if gamesPlaying[key] || gameOnCooldown("gamble", message.User.ID, ch) {
+		gamesMutex.Unlock()
+		return ""
+	}
+	gamesPlaying[key] = true
+	gamesMutex.Unlock()
+	settled := false
+	defer func() {
+		gamesMutex.Lock()
+		delete(gamesPlaying, key)
+		if settled {
+			gamePlayed("gamble", message.User.ID, ch)
+		}
+		gamesMutex.Unlock()
+	}()
+
+	roll, err := rollPercent()
+	if err != nil {
+		zap.S().Errorf("Couldn't roll for gamble: %v", err)
+		return "The dice went missing, try again later."
+	}
+	won := roll < int64(SettingGetInt("games.gamble.winchance", ch.database))
+	winnings := int64(float64(stake) * SettingGetFloat("games.gamble.payout", ch.database))
+
+	var balance int64
+	err = WithTx(ch.database, func(tx *sql.Tx) error {
+		var err error
+		balance, err = PointsAdjust(tx, message.User.ID, message.User.Name, -stake, "gamble:stake")
+		if err != nil || !won {
+			return err
+		}
+		balance, err = PointsAdjust(tx, message.User.ID, message.User.Name, winnings, "gamble:win")
+		return err
+	})
+	if err == errInsufficientPoints {
+		return fmt.Sprintf("Sorry {user}, you don't have %d %s.", stake, name)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't run that gamble due to a SQL error."
+	}
+	settled = true
+	if won {
+		// The payout includes the stake back, so the win is what's left over.
+		return fmt.Sprintf("{user} rolled %d and won %d %s! You now have %d.", roll, winnings-stake, name, balance)
+	}
+	return fmt.Sprintf("{user} rolled %d and lost %d %s. You now have %d.", roll, stake, name, balance)
+}
+
+/* Duel */
+
+func DuelCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	fields := strings.Fields(options)
+	if len(fields) < 2 {
+		return "Usage: !duel @user <amount>"
+	}
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	if target == message.User.Name {
+		return "You can't duel yourself {user}."
+	}
+	stake, problem := gameStake("duel", fields[1], ch)
+	if problem != "" {
+		return problem
+	}
+	if PointsBalance(message.User.ID, ch.database) < stake {
+		return fmt.Sprintf("Sorry {user}, you don't have %d %s.", stake, name)
+	}
+	if _, balance, err := PointsLookup(target, ch.database); err != nil || balance < stake {
+		return fmt.Sprintf("%s doesn't have %d %s to duel with.", target, stake, name)
+	}
+
+	gamesMutex.Lock()
+	defer gamesMutex.Unlock()
+	if gameOnCooldown("duel", message.User.ID, ch) {
+		return ""
+	}
+	if duels[ch.name] == nil {
+		duels[ch.name] = make(map[string]*duel)
+	}
+	if duels[ch.name][target] != nil {
+		return fmt.Sprintf("%s already has a duel waiting.", target)
+	}
+	gamePlayed("duel", message.User.ID, ch)
+
+	d := &duel{challengerID: message.User.ID, challengerName: message.User.Name, targetName: target, amount: stake}
+	timeout := time.Duration(SettingGetInt("games.duel.timeout", ch.database)) * time.Second
+	d.timer = time.AfterFunc(timeout, func() {
+		gamesMutex.Lock()
+		defer gamesMutex.Unlock()
+		if duels[ch.name][target] == d {
+			delete(duels[ch.name], target)
+			SendChannelMessage(ch.name, fmt.Sprintf("%s didn't answer %s's duel in time.", target, d.challengerName))
+		}
+	})
+	duels[ch.name][target] = d
+	return fmt.Sprintf("@%s, {user} challenges you to a duel for %d %s! Type !accept or !decline within %v.", target, stake, name, timeout)
+}
+
+// DuelAnswer handles !accept and !decline from the challenged viewer.
+func DuelAnswer(message twitch.PrivateMessage, accept bool, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	gamesMutex.Lock()
+	d := duels[ch.name][message.User.Name]
+	if d != nil {
+		d.timer.Stop()
+		delete(duels[ch.name], message.User.Name)
+	}
+	gamesMutex.Unlock()
+	if d == nil {
+		return ""
+	}
+	if !accept {
+		return fmt.Sprintf("{user} declined %s's duel.", d.challengerName)
+	}
+
+	roll, err := rollPercent()
+	if err != nil {
+		zap.S().Errorf("Couldn't roll for duel: %v", err)
+		return "The duel was called off, try again later."
+	}
+	winnerID, winnerName, loserName := d.challengerID, d.challengerName, message.User.Name
+	if roll >= 50 {
+		winnerID, winnerName, loserName = message.User.ID, message.User.Name, d.challengerName
+	}
+
+	// Both stakes go into the pot and the winner takes it, all in one transaction.
+	reason := fmt.Sprintf("duel:%s-%s", d.challengerName, message.User.Name)
+	var short string
+	err = WithTx(ch.database, func(tx *sql.Tx) error {
+		if _, err := PointsAdjust(tx, d.challengerID, d.challengerName, -d.amount, reason); err != nil {
+			short = d.challengerName
+			return err
+		}
+		if _, err := PointsAdjust(tx, message.User.ID, message.User.Name, -d.amount, reason); err != nil {
+			short = message.User.Name
+			return err
+		}
+		_, err := PointsAdjust(tx, winnerID, winnerName, 2*d.amount, reason)
+		return err
+	})
+	if err == errInsufficientPoints {
+		return fmt.Sprintf("The duel is off, %s doesn't have %d %s anymore.", short, d.amount, name)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't run that duel due to a SQL error."
+	}
+	return fmt.Sprintf("%s wins the duel against %s and takes %d %s!", winnerName, loserName, d.amount, name)
+}
@@ -0,0 +1,341 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["giveaway.claimseconds"] = "60"
+}
+
+type giveawayEntry struct {
+	userID   string
+	userName string
+	tickets  int64
+	paid     int64
+	drawn    bool
+}
+
+type giveaway struct {
+	id          int64
+	keyword     string
+	requirement string
+	cost        int64
+	weighted    bool
+	open        bool
+	entries     []*giveawayEntry
+	entered     map[string]*giveawayEntry
+	pending     *giveawayEntry
+	timer       *time.Timer
+}
+
+var (
+	giveawayMutex sync.Mutex
+	giveaways     = make(map[string]*giveaway)
+)
+
+/* Giveaway Tables */
+
+func giveawayDBStatus(id int64, status string, db *sql.DB) {
+	_, err := db.Exec("UPDATE giveaways SET status = $1, ended = CURRENT_TIMESTAMP WHERE id = $2;", status, id)
+	if err != nil {
+		handleSQLError(err)
+	}
+}
+
+/* Drawing */
+
+// pickWinner draws one undrawn entry using crypto/rand, weighted by tickets.
+func (g *giveaway) pickWinner() (*giveawayEntry, int64, error) {
+	var total int64
+	for _, entry := range g.entries {
+		if !entry.drawn {
+			total += entry.tickets
+		}
+	}
+	if total == 0 {
+		return nil, 0, errors.New("no entries left to draw")
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(total))
+	if err != nil {
+		return nil, 0, err
+	}
+	roll := n.Int64()
+	for _, entry := range g.entries {
+		if entry.drawn {
+			continue
+		}
+		if roll < entry.tickets {
+			return entry, total, nil
+		}
+		roll -= entry.tickets
+	}
+	return nil, 0, errors.New("draw fell outside the ticket range")
+}
+
+// giveawayDraw picks a winner and gives them the claim window to speak up. Callers hold giveawayMutex.
+func giveawayDraw(g *giveaway, ch broadcaster) string {
+	g.open = false
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	winner, total, err := g.pickWinner()
+	if err != nil {
+		zap.S().Infof("Giveaway %v in %v ended without a winner: %v", g.id, ch.name, err)
+		giveawayDBStatus(g.id, "nowinner", ch.database)
+		delete(giveaways, ch.name)
+		return "There's nobody left to draw, the giveaway is over."
+	}
+	winner.drawn = true
+	g.pending = winner
+	_, err = ch.database.Exec("INSERT INTO giveawaydraws (giveawayid, userid, username, tickets, totaltickets) VALUES ($1, $2, $3, $4, $5);", g.id, winner.userID, winner.userName, winner.tickets, total)
+	if err != nil {
+		handleSQLError(err)
+	}
+
+	claim := time.Duration(SettingGetInt("giveaway.claimseconds", ch.database)) * time.Second
+	g.timer = time.AfterFunc(claim, func() {
+		giveawayMutex.Lock()
+		defer giveawayMutex.Unlock()
+		if giveaways[ch.name] != g || g.pending != winner {
+			return
+		}
+		SendChannelMessage(ch.name, fmt.Sprintf("%s didn't claim in time. %s", winner.userName, giveawayDraw(g, ch)))
+	})
+	return fmt.Sprintf("@%s won the giveaway! Say something in chat within %v to claim it.", winner.userName, claim)
+}
+
+/* Chat Hooks */
+
+// GiveawayObserve handles keyword entries and winners claiming their prize.
+func GiveawayObserve(message twitch.PrivateMessage, ch broadcaster) {
+	giveawayMutex.Lock()
+	g := giveaways[ch.name]
+	if g == nil {
+		giveawayMutex.Unlock()
+		return
+	}
+	if g.pending != nil && g.pending.userID == message.User.ID {
+		g.pending = nil
+		g.timer.Stop()
+		delete(giveaways, ch.name)
+		giveawayMutex.Unlock()
+
+		_, err := ch.database.Exec("UPDATE giveawaydraws SET claimed = true WHERE giveawayid = $1 AND userid = $2;", g.id, message.User.ID)
+		if err != nil {
+			handleSQLError(err)
+		}
+		giveawayDBStatus(g.id, "claimed", ch.database)
+		SendChannelMessage(ch.name, fmt.Sprintf("Congratulations %s, the prize is yours!", message.User.Name))
+		return
+	}
+	keyword := g.keyword
+	giveawayMutex.Unlock()
+
+	if strings.EqualFold(strings.TrimSpace(message.Message), keyword) {
+		if result := GiveawayEnter(message, ch); result != "" {
+			SendChannelMessage(ch.name, FormatResponse(result, message))
+		}
+	}
+}
+
+// GiveawayEnter adds the viewer to the running giveaway, checking its requirements first.
+func GiveawayEnter(message twitch.PrivateMessage, ch broadcaster) string {
+	giveawayMutex.Lock()
+	g := giveaways[ch.name]
+	if g == nil || !g.open {
+		giveawayMutex.Unlock()
+		return ""
+	}
+	if _, ok := g.entered[message.User.ID]; ok {
+		giveawayMutex.Unlock()
+		return ""
+	}
+	requirement, cost, weighted := g.requirement, g.cost, g.weighted
+	giveawayMutex.Unlock()
+
+	months := SubscriberMonths(ProcessUserSubscription(message.Tags))
+	subscribed := message.User.Badges["subscriber"] > 0 || message.User.Badges["founder"] > 0
+	switch requirement {
+	case "sub":
+		if !subscribed {
+			return "Sorry {user}, this giveaway is for subscribers only."
+		}
+	case "follow":
+		follows, err := HelixUserFollows(message.User.ID, message.RoomID)
+		if err != nil {
+			zap.S().Errorf("Couldn't check if %v follows %v: %v", message.User.Name, ch.name, err)
+			return "Sorry {user}, I couldn't check if you follow right now."
+		}
+		if !follows {
+			return "Sorry {user}, this giveaway is for followers only."
+		}
+	}
+
+	entry := &giveawayEntry{userID: message.User.ID, userName: message.User.Name, tickets: 1, paid: cost}
+	if weighted && subscribed && months > 0 {
+		entry.tickets += int64(months)
+	}
+
+	err := WithTx(ch.database, func(tx *sql.Tx) error {
+		if cost > 0 {
+			if _, err := PointsAdjust(tx, entry.userID, entry.userName, -cost, fmt.Sprintf("giveaway:%d", g.id)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("INSERT INTO giveawayentries (giveawayid, userid, username, tickets) VALUES ($1, $2, $3, $4);", g.id, entry.userID, entry.userName, entry.tickets)
+		return err
+	})
+	if err == errInsufficientPoints {
+		return fmt.Sprintf("Sorry {user}, entering costs %d %s.", cost, SettingGet("points.name", ch.database))
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't enter you due to a SQL error."
+	}
+
+	giveawayMutex.Lock()
+	defer giveawayMutex.Unlock()
+	if giveaways[ch.name] != g || !g.open {
+		// The giveaway closed while we were charging, so hand the points back.
+		giveawayRefund([]*giveawayEntry{entry}, g.id, ch)
+		return ""
+	}
+	if _, ok := g.entered[entry.userID]; ok {
+		giveawayRefund([]*giveawayEntry{entry}, g.id, ch)
+		return ""
+	}
+	g.entered[entry.userID] = entry
+	g.entries = append(g.entries, entry)
+	return ""
+}
+
+func giveawayRefund(entries []*giveawayEntry, id int64, ch broadcaster) {
+	for _, entry := range entries {
+		if entry.paid <= 0 {
+			continue
+		}
+		err := WithTx(ch.database, func(tx *sql.Tx) error {
+			_, err := PointsAdjust(tx, entry.userID, entry.userName, entry.paid, fmt.Sprintf("giveawayrefund:%d", id))
+			return err
+		})
+		if err != nil {
+			handleSQLError(err)
+		}
+	}
+}
+
+/* Commands */
+
+// GiveawayCommand handles the mod side: !giveaway start <keyword> [duration] [follow|sub] [cost=N] [weighted], close, draw, reroll, cancel.
+func GiveawayCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return "Usage: !giveaway start <keyword> [duration] [follow|sub] [cost=N] [weighted], or !giveaway close|draw|reroll|cancel"
+	}
+
+	giveawayMutex.Lock()
+	defer giveawayMutex.Unlock()
+	g := giveaways[ch.name]
+
+	switch strings.ToLower(fields[0]) {
+	case "start":
+		if g != nil {
+			return "There's already a giveaway running."
+		}
+		if len(fields) < 2 {
+			return "Usage: !giveaway start <keyword> [duration] [follow|sub] [cost=N] [weighted]"
+		}
+		g = &giveaway{keyword: fields[1], requirement: "none", open: true, entered: make(map[string]*giveawayEntry)}
+		var duration time.Duration
+		for _, option := range fields[2:] {
+			option = strings.ToLower(option)
+			if d, ok := parseChatDuration(option); ok {
+				duration = d
+			} else if option == "follow" || option == "sub" {
+				g.requirement = option
+			} else if option == "weighted" {
+				g.weighted = true
+			} else if strings.HasPrefix(option, "cost=") {
+				cost, err := strconv.ParseInt(strings.TrimPrefix(option, "cost="), 10, 64)
+				if err != nil || cost < 0 {
+					return "The cost needs to be a positive number."
+				}
+				g.cost = cost
+			} else {
+				return fmt.Sprintf("I don't understand the giveaway option %s.", option)
+			}
+		}
+
+		err := ch.database.QueryRow("INSERT INTO giveaways (keyword, startedby, requirement, cost, weighted, status) VALUES ($1, $2, $3, $4, $5, 'open') RETURNING id;", g.keyword, message.User.Name, g.requirement, g.cost, g.weighted).Scan(&g.id)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't start the giveaway due to a SQL error."
+		}
+		giveaways[ch.name] = g
+
+		result := fmt.Sprintf("Giveaway started! Type %s or !enter to join", g.keyword)
+		if g.requirement == "follow" {
+			result += " (followers only)"
+		} else if g.requirement == "sub" {
+			result += " (subscribers only)"
+		}
+		if g.cost > 0 {
+			result += fmt.Sprintf(", entry costs %d %s", g.cost, SettingGet("points.name", ch.database))
+		}
+		if g.weighted {
+			result += ", subs get a bonus ticket per month subscribed"
+		}
+		if duration > 0 {
+			result += fmt.Sprintf(". Drawing in %v", duration)
+			g.timer = time.AfterFunc(duration, func() {
+				giveawayMutex.Lock()
+				defer giveawayMutex.Unlock()
+				if giveaways[ch.name] != g || !g.open {
+					return
+				}
+				SendChannelMessage(ch.name, giveawayDraw(g, ch))
+			})
+		}
+		return result + "."
+	case "close":
+		if g == nil || !g.open {
+			return "There's no open giveaway."
+		}
+		g.open = false
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		giveawayDBStatus(g.id, "closed", ch.database)
+		return fmt.Sprintf("Giveaway entries are closed with %d entrants.", len(g.entries))
+	case "draw", "reroll":
+		if g == nil {
+			return "There's no giveaway running."
+		}
+		return giveawayDraw(g, ch)
+	case "cancel":
+		if g == nil {
+			return "There's no giveaway running."
+		}
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		delete(giveaways, ch.name)
+		giveawayRefund(g.entries, g.id, ch)
+		giveawayDBStatus(g.id, "cancelled", ch.database)
+		return "The giveaway was cancelled and any entry costs were refunded."
+	default:
+		return "Usage: !giveaway start <keyword> [duration] [follow|sub] [cost=N] [weighted], or !giveaway close|draw|reroll|cancel"
+	}
+}
@@ -1,15 +1,21 @@
 module github.com/frozensake/golang-twitch-bot
 
-go 1.14
+go 1.18
 
 require (
 	github.com/aws/aws-sdk-go v1.34.34
 	github.com/gempir/go-twitch-irc/v2 v2.4.0
-	github.com/jackc/pgx/v4 v4.10.1 // indirect
 	github.com/joho/godotenv v1.3.0
 	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	go.uber.org/zap v1.10.0
-	golang.org/x/net v0.0.0-20200927032502-5d4f70055728 // indirect
-	golang.org/x/text v0.3.3 // indirect
+	golang.org/x/net v0.0.0-20200927032502-5d4f70055728
+	golang.org/x/text v0.3.3
+)
+
+require (
+	github.com/jackc/pgx/v4 v4.10.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
 )
@@ -0,0 +1,229 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	helixBase = "https://api.twitch.tv/helix"
+	helixAuth = "https://id.twitch.tv/oauth2/token"
+)
+
+var (
+	helixClientID     string
+	helixClientSecret string
+
+	helixMutex       sync.Mutex
+	helixToken       string
+	helixTokenExpiry time.Time
+	helixHTTP        = &http.Client{Timeout: 10 * time.Second}
+)
+
+var errHelixDisabled = errors.New("helix credentials are not configured")
+
+/* Authentication */
+
+// helixAppToken returns a cached app access token, fetching a new one with the client credentials flow when needed.
+func helixAppToken() (string, error) {
+	if helixClientID == "" || helixClientSecret == "" {
+		return "", errHelixDisabled
+	}
+	helixMutex.Lock()
+	defer helixMutex.Unlock()
+	if helixToken != "" && time.Now().Before(helixTokenExpiry) {
+		return helixToken, nil
+	}
+
+	zap.S().Info("Requesting a new Helix app token")
+	form := url.Values{}
+	form.Set("client_id", helixClientID)
+	form.Set("client_secret", helixClientSecret)
+	form.Set("grant_type", "client_credentials")
+	resp, err := helixHTTP.PostForm(helixAuth, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("helix token request failed: %v", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	helixToken = body.AccessToken
+	// Refresh a minute early so a request never goes out with a token that's about to lapse.
+	helixTokenExpiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return helixToken, nil
+}
+
+func helixGet(path string, query url.Values, out interface{}) error {
+	token, err := helixAppToken()
+	if err != nil {
+		return err
+	}
+	status, err := helixDo(http.MethodGet, token, path, query, nil, out)
+	if status == http.StatusUnauthorized {
+		helixMutex.Lock()
+		helixToken = ""
+		helixMutex.Unlock()
+	}
+	return err
+}
+
+// helixModeratorGet calls an endpoint that needs a moderator's token rather than the app's. It uses the bot's
+// own token, so the bot has to be a mod in the channel and its token has to carry the endpoint's scope.
+func helixModeratorGet(path string, query url.Values, out interface{}) error {
+	if helixClientID == "" || oauth == "" {
+		return errHelixDisabled
+	}
+	_, err := helixDo(http.MethodGet, strings.TrimPrefix(oauth, oauthForm), path, query, nil, out)
+	return err
+}
+
+// helixModeratorPost is helixModeratorGet for endpoints that take a JSON body.
+func helixModeratorPost(path string, body, out interface{}) error {
+	if helixClientID == "" || oauth == "" {
+		return errHelixDisabled
+	}
+	_, err := helixDo(http.MethodPost, strings.TrimPrefix(oauth, oauthForm), path, nil, body, out)
+	return err
+}
+
+func helixDo(method, token, path string, query url.Values, body, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, helixBase+path+"?"+query.Encode(), reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Client-ID", helixClientID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := helixHTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Creating things answers 202 Accepted rather than 200.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return resp.StatusCode, fmt.Errorf("helix %v failed: %v", path, resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+/* Streams */
+
+// HelixStreamLive reports whether the channel is currently broadcasting.
+func HelixStreamLive(channelName string) (bool, error) {
+	id, err := HelixStreamID(channelName)
+	return id != "", err
+}
+
+// HelixStreamID returns the id of the channel's live stream, or "" when it's offline.
+func HelixStreamID(channelName string) (string, error) {
+	var body struct {
+		Data []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"data"`
+	}
+	if err := helixGet("/streams", url.Values{"user_login": {channelName}}, &body); err != nil {
+		return "", err
+	}
+	if len(body.Data) == 0 || body.Data[0].Type != "live" {
+		return "", nil
+	}
+	return body.Data[0].ID, nil
+}
+
+/* Users */
+
+// HelixUserID looks a login up, returning "" when there's no such user.
+func HelixUserID(login string) (string, error) {
+	var body struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := helixGet("/users", url.Values{"login": {login}}, &body); err != nil {
+		return "", err
+	}
+	if len(body.Data) == 0 {
+		return "", nil
+	}
+	return body.Data[0].ID, nil
+}
+
+// HelixUserFollows reports whether the user follows the channel, both given by user-id.
+// It needs the bot's token to have moderator:read:followers, and the bot to be a mod in the channel.
+func HelixUserFollows(userID, channelID string) (bool, error) {
+	var body struct {
+		Data []struct {
+			UserID string `json:"user_id"`
+		} `json:"data"`
+	}
+	if err := helixModeratorGet("/channels/followers", url.Values{"broadcaster_id": {channelID}, "user_id": {userID}}, &body); err != nil {
+		return false, err
+	}
+	return len(body.Data) > 0, nil
+}
+
+// HelixChannelRoles returns the logins of the channel's mods and VIPs, given its user-id.
+// It needs the bot's token to have moderator:read:moderators and moderator:read:vips, and the bot to be a mod.
+func HelixChannelRoles(channelID string) (map[string]bool, error) {
+	roles := make(map[string]bool)
+	for _, path := range []string{"/moderation/moderators", "/channels/vips"} {
+		cursor := ""
+		for {
+			var body struct {
+				Data []struct {
+					UserLogin string `json:"user_login"`
+				} `json:"data"`
+				Pagination struct {
+					Cursor string `json:"cursor"`
+				} `json:"pagination"`
+			}
+			query := url.Values{"broadcaster_id": {channelID}, "first": {"100"}}
+			if cursor != "" {
+				query.Set("after", cursor)
+			}
+			if err := helixModeratorGet(path, query, &body); err != nil {
+				return nil, err
+			}
+			for _, user := range body.Data {
+				roles[strings.ToLower(user.UserLogin)] = true
+			}
+			if body.Pagination.Cursor == "" {
+				break
+			}
+			cursor = body.Pagination.Cursor
+		}
+	}
+	return roles, nil
+}
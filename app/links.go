@@ -0,0 +1,209 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+func init() {
+	settingDefaults["filter.links.enabled"] = "true"
+	settingDefaults["filter.links.action"] = "delete"
+	settingDefaults["filter.links.exempt"] = "vip"
+	settingDefaults["filter.links.permitseconds"] = "60"
+	settingDefaults["filter.links.allowlist"] = "clips.twitch.tv"
+	settingValidators["filter.links.action"] = validModAction
+	settingValidators["filter.links.exempt"] = validRole
+	settingValidators["filter.links.allowlist"] = validDomainList
+	messageFilters = append(messageFilters, linksFilter)
+}
+
+// Top-level domains that count as a link without a scheme. The obfuscated form ("example dot com")
+// only uses the short list, since words like "me" or "to" turn up after a full stop all the time.
+const (
+	linkTLDs           = `com|net|org|io|tv|gg|co|me|to|uk|de|ru|us|ca|au|fr|nl|xyz|info|biz|ly|be|app|dev|live|site|online|shop|store|club|fun|top|vip|pro|cc|ws|su|in|es|it|pl|br|jp|cn|link|gl|sh|so|fm|am|ai|tk|ml|ga|cf|gq`
+	obfuscatedLinkTLDs = `com|net|org|io|tv|gg|xyz|ru|ly|tk`
+)
+
+var (
+	schemeLink     = regexp.MustCompile(`(?i)\b(?:https?|ftp)://([^\s/?#]+)`)
+	bareLink       = regexp.MustCompile(`(?i)\b((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:` + linkTLDs + `))\b(?:[/:?#]\S*)?`)
+	obfuscatedDot  = regexp.MustCompile(`(?i)\s*(?:[\(\[\{<]\s*(?:dot|\.)\s*[\)\]\}>]|\s\.\s|\sdot\s)\s*`)
+	obfuscatedLink = regexp.MustCompile(`(?i)\b((?:[a-z0-9-]+\.)+(?:` + obfuscatedLinkTLDs + `))\b`)
+
+	permitsMutex sync.Mutex
+	permits      = make(map[string]map[string]time.Time)
+)
+
+/* Detection */
+
+// MessageLinks returns the hosts of every link in the text, including ones spelled out as "example dot com".
+func MessageLinks(text string) []string {
+	var hosts []string
+	for _, match := range schemeLink.FindAllStringSubmatch(text, -1) {
+		hosts = append(hosts, match[1])
+	}
+	for _, match := range bareLink.FindAllStringSubmatch(text, -1) {
+		hosts = append(hosts, match[1])
+	}
+	if deobfuscated := obfuscatedDot.ReplaceAllString(text, "."); deobfuscated != text {
+		for _, match := range obfuscatedLink.FindAllStringSubmatch(deobfuscated, -1) {
+			hosts = append(hosts, match[1])
+		}
+	}
+
+	seen := make(map[string]bool)
+	unique := hosts[:0]
+	for _, host := range hosts {
+		host = strings.TrimPrefix(strings.ToLower(strings.Split(host, ":")[0]), "www.")
+		if host != "" && !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+// linkAllowed checks the host against the channel's allowlist. Allowing a domain allows its subdomains too.
+func linkAllowed(host string, ch broadcaster) bool {
+	for _, domain := range strings.Split(SettingGet("filter.links.allowlist", ch.database), ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validDomainList(value string) string {
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" && !bareLink.MatchString(domain) {
+			return fmt.Sprintf("%s isn't a domain I recognise.", domain)
+		}
+	}
+	return ""
+}
+
+/* Permits */
+
+// usePermit spends the user's permit if they have one that hasn't run out.
+func usePermit(userName string, ch broadcaster) bool {
+	permitsMutex.Lock()
+	defer permitsMutex.Unlock()
+	expiry, ok := permits[ch.name][userName]
+	if !ok {
+		return false
+	}
+	delete(permits[ch.name], userName)
+	return time.Now().Before(expiry)
+}
+
+func linksFilter(message twitch.PrivateMessage, ch broadcaster) *filterHit {
+	if !SettingGetBool("filter.links.enabled", ch.database) || filterExempt("links", message, ch) {
+		return nil
+	}
+	blocked := ""
+	for _, host := range MessageLinks(message.Message) {
+		if !linkAllowed(host, ch) {
+			blocked = host
+			break
+		}
+	}
+	if blocked == "" || usePermit(message.User.Name, ch) {
+		return nil
+	}
+	return &filterHit{filter: "links", reason: "links aren't allowed without a !permit", action: filterAction("links", ch)}
+}
+
+/* Commands */
+
+// PermitCommand handles !permit <user> [seconds], letting the user post one link.
+func PermitCommand(options string, ch broadcaster) string {
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		return "Usage: !permit <user> [seconds]"
+	}
+	target := strings.TrimPrefix(fields[0], "@")
+	seconds := SettingGetInt("filter.links.permitseconds", ch.database)
+	if len(fields) > 1 {
+		var err error
+		if seconds, err = strconv.Atoi(fields[1]); err != nil || seconds < 1 {
+			return "Usage: !permit <user> [seconds]"
+		}
+	}
+
+	permitsMutex.Lock()
+	if permits[ch.name] == nil {
+		permits[ch.name] = make(map[string]time.Time)
+	}
+	permits[ch.name][target] = time.Now().Add(time.Duration(seconds) * time.Second)
+	permitsMutex.Unlock()
+	return fmt.Sprintf("@%s, you can post one link in the next %d seconds.", target, seconds)
+}
+
+// AllowlistCommand handles !allowlist add|remove <domain> and !allowlist list.
+func AllowlistCommand(options string, ch broadcaster) string {
+	usage := "Usage: !allowlist add|remove <domain>, or !allowlist list"
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		return usage
+	}
+
+	domains := make(map[string]bool)
+	for _, domain := range strings.Split(SettingGet("filter.links.allowlist", ch.database), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains[domain] = true
+		}
+	}
+	if fields[0] == "list" {
+		if len(domains) == 0 {
+			return "No domains are allowed."
+		}
+		return "Allowed domains: " + strings.Join(sortedKeys(domains), ", ")
+	}
+	if len(fields) < 2 {
+		return usage
+	}
+	hosts := MessageLinks(fields[1])
+	if len(hosts) != 1 {
+		return fmt.Sprintf("%s isn't a domain I recognise.", fields[1])
+	}
+	domain := hosts[0]
+
+	switch fields[0] {
+	case "add":
+		domains[domain] = true
+	case "remove":
+		if !domains[domain] {
+			return fmt.Sprintf("%s isn't on the allowlist.", domain)
+		}
+		delete(domains, domain)
+	default:
+		return usage
+	}
+	if err := SettingSet("filter.links.allowlist", strings.Join(sortedKeys(domains), ","), ch.database); err != nil {
+		handleSQLError(err)
+		return "I couldn't save the allowlist due to a SQL error."
+	}
+	if fields[0] == "add" {
+		return domain + " is now allowed."
+	}
+	return domain + " is no longer allowed."
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Migrations live in migrations/<set>/NNNN_name.up.sql with a matching .down.sql, numbered from 0001
+// with no gaps. A set builds one kind of database: postgres/bot, postgres/channel or sqlite. The channel
+// features are a set of their own, postgres/features, run after postgres/channel in a channel database and
+// alone in a shared feature schema. Migrations that run against databases created before the set existed
+// use IF NOT EXISTS, so those databases adopt the set without losing anything.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d{4})_(\w+)\.(up|down)\.sql$`)
+
+// migrationBaselines is the lowest version each set can be taken down to. The migrations up to it adopted
+// tables older than the set, so their downs would drop data no migration created. Every migration after
+// the baseline creates what it drops.
+var migrationBaselines = map[string]int{"postgres/bot": 1, "postgres/channel": 2}
+
+// migrationLock is the Postgres advisory lock held while migrating, so instances starting together, as in a
+// blue/green deploy, take turns instead of running the same migration twice.
+const migrationLock = 4262046
+
+// migrationTables is where a set that shares its database with another records its versions.
+// The rest use schema_version.
+var migrationTables = map[string]string{"postgres/features": "feature_version"}
+
+func migrationTable(set string) string {
+	if table, ok := migrationTables[set]; ok {
+		return table
+	}
+	return "schema_version"
+}
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads a set, in order.
+func loadMigrations(set string) ([]migration, error) {
+	dir := path.Join("migrations", set)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migration set %q", set)
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%s/%s isn't named NNNN_name.up.sql or NNNN_name.down.sql", set, entry.Name())
+		}
+		body, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		version, _ := strconv.Atoi(match[1])
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("%s has two migrations numbered %d", set, version)
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("%s skips from %d to %d", set, i, m.version)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("%s migration %d needs both an up and a down", set, m.version)
+		}
+	}
+	return migrations, nil
+}
+
+// SchemaVersion is the last migration of the set applied to the database, or 0 for none.
+func SchemaVersion(db *sql.DB, set string) (int, error) {
+	// A row per applied migration, so the table says when each one ran.
+	table := migrationTable(set)
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table + " (version INTEGER PRIMARY KEY, name TEXT, applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP);"); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + table + ";").Scan(&version)
+	return version, err
+}
+
+// Migrate moves the database up or down to the target version of the set. A negative target is the latest.
+// Each migration commits on its own, so a failure leaves the database at the last one that worked.
+func Migrate(db *sql.DB, set string, target int) (int, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return 0, err
+	}
+	if target < 0 || target > len(migrations) {
+		target = len(migrations)
+	}
+	// The lock is held on a connection of its own for the whole run, and the version is only read once it's
+	// held, so an instance that waited sees what the other one applied.
+	if _, postgres := db.Driver().(*pq.Driver); postgres {
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLock); err != nil {
+			return 0, err
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1);", migrationLock)
+	}
+	version, err := SchemaVersion(db, set)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return version, fmt.Errorf("the database is at version %d, newer than this bot's %s migrations", version, set)
+	}
+	if baseline := migrationBaselines[set]; target < baseline && version > target {
+		return version, fmt.Errorf("%s can't go below version %d, whose migrations adopted tables older than them", set, baseline)
+	}
+
+	for version < target {
+		m := migrations[version]
+		zap.S().Infof("Migrating %s up to %d: %s", set, m.version, m.name)
+		err := WithTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO "+migrationTable(set)+" (version, name) VALUES ($1, $2);", m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return version, fmt.Errorf("%s migration %d (%s): %v", set, m.version, m.name, err)
+		}
+		version = m.version
+	}
+	for version > target {
+		m := migrations[version-1]
+		zap.S().Infof("Migrating %s down from %d: %s", set, m.version, m.name)
+		err := WithTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM "+migrationTable(set)+" WHERE version = $1;", m.version)
+			return err
+		})
+		if err != nil {
+			return version, fmt.Errorf("%s migration %d (%s) down: %v", set, m.version, m.name, err)
+		}
+		version = m.version - 1
+	}
+	return version, nil
+}
+
+// migrateOnStart is true unless DB_MIGRATE=manual, which leaves migrations to `bot migrate`.
+func migrateOnStart() bool {
+	return os.Getenv("DB_MIGRATE") != "manual"
+}
+
+// MigrateOnConnect brings a database up to date as the bot starts using it, or with manual migrations,
+// only warns when it's behind.
+func MigrateOnConnect(db *sql.DB, set, name string) error {
+	if migrateOnStart() {
+		_, err := Migrate(db, set, -1)
+		return err
+	}
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion(db, set)
+	if err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		zap.S().Warnf("%v is at schema version %d of %d; run `bot migrate up`", name, version, len(migrations))
+	}
+	return nil
+}
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS broadcasters (id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY, channelname TEXT UNIQUE, dbcreated BOOL, authorized BOOL);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS quotes;
+DROP TABLE IF EXISTS channelusers;
+DROP TABLE IF EXISTS commands;
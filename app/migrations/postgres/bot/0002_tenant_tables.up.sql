@@ -0,0 +1,5 @@
+-- The shared tables for DB_TENANCY=shared, where every channel's rows live in the bot DB keyed by its broadcasters id.
+-- They stay empty when each channel has a database of its own.
+CREATE TABLE IF NOT EXISTS commands (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, channel_id INTEGER NOT NULL, trigger TEXT, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER, cost INTEGER DEFAULT 0, UNIQUE (channel_id, trigger));
+CREATE TABLE IF NOT EXISTS channelusers (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, channel_id INTEGER NOT NULL, name TEXT, aliases TEXT[], lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT, UNIQUE (channel_id, name));
+CREATE TABLE IF NOT EXISTS quotes (channel_id INTEGER NOT NULL, id INTEGER NOT NULL, quote TEXT, addedby TEXT, PRIMARY KEY (channel_id, id));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS sharedbanaudit;
+DROP TABLE IF EXISTS sharedbans;
+DROP TABLE IF EXISTS triviaquestions;
@@ -0,0 +1,4 @@
+-- The default trivia bank and the shared ban list span channels. Both used to be created as the bot started.
+CREATE TABLE IF NOT EXISTS triviaquestions (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, category TEXT, question TEXT UNIQUE, answers TEXT);
+CREATE TABLE IF NOT EXISTS sharedbans (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, username TEXT, tag TEXT, reason TEXT, channel TEXT, moderator TEXT, active BOOL DEFAULT true, created TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS sharedbanaudit (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, banid INTEGER, channel TEXT, action TEXT, actor TEXT, at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
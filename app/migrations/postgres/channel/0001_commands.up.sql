@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS commands (id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY, trigger TEXT UNIQUE, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER);
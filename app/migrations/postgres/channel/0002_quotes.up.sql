@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS quotes (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, quote TEXT, addedby TEXT);
@@ -0,0 +1,2 @@
+-- aliases used to be BLOB, which Postgres doesn't have, so no channel ever got this table.
+CREATE TABLE IF NOT EXISTS channelusers (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, name TEXT UNIQUE, aliases TEXT[], lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT);
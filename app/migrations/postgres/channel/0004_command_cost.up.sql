@@ -0,0 +1 @@
+ALTER TABLE commands ADD COLUMN IF NOT EXISTS cost INTEGER DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS pointsledger;
+DROP TABLE IF EXISTS points;
+DROP TABLE IF EXISTS settings;
@@ -0,0 +1,4 @@
+-- Settings arrived with points, which were the first feature with anything to configure.
+CREATE TABLE IF NOT EXISTS settings (name TEXT PRIMARY KEY, value TEXT);
+CREATE TABLE IF NOT EXISTS points (userid TEXT PRIMARY KEY, username TEXT, balance BIGINT NOT NULL DEFAULT 0 CHECK (balance >= 0));
+CREATE TABLE IF NOT EXISTS pointsledger (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, userid TEXT, delta BIGINT, reason TEXT, created TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS giveawaydraws;
+DROP TABLE IF EXISTS giveawayentries;
+DROP TABLE IF EXISTS giveaways;
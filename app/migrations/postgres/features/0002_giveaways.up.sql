@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS giveaways (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, keyword TEXT, startedby TEXT, requirement TEXT, cost BIGINT, weighted BOOL, status TEXT, started TIMESTAMP DEFAULT CURRENT_TIMESTAMP, ended TIMESTAMP);
+CREATE TABLE IF NOT EXISTS giveawayentries (giveawayid INTEGER, userid TEXT, username TEXT, tickets BIGINT, entered TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS giveawaydraws (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, giveawayid INTEGER, userid TEXT, username TEXT, tickets BIGINT, totaltickets BIGINT, claimed BOOL DEFAULT false, drawn TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS pollvotes;
+DROP TABLE IF EXISTS polloptions;
+DROP TABLE IF EXISTS polls;
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS polls (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, question TEXT, startedby TEXT, status TEXT, started TIMESTAMP DEFAULT CURRENT_TIMESTAMP, ended TIMESTAMP);
+CREATE TABLE IF NOT EXISTS polloptions (pollid INTEGER, position INTEGER, label TEXT, PRIMARY KEY (pollid, position));
+CREATE TABLE IF NOT EXISTS pollvotes (pollid INTEGER, userid TEXT, username TEXT, choice INTEGER, voted TIMESTAMP DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (pollid, userid));
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS predictionpayouts;
+DROP TABLE IF EXISTS predictionbets;
+DROP TABLE IF EXISTS predictionoutcomes;
+DROP TABLE IF EXISTS predictions;
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS predictions (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, question TEXT, status TEXT, pool BIGINT DEFAULT 0, winner INTEGER, openedby TEXT, opened TIMESTAMP DEFAULT CURRENT_TIMESTAMP, finished TIMESTAMP);
+CREATE TABLE IF NOT EXISTS predictionoutcomes (predictionid INTEGER, position INTEGER, label TEXT, PRIMARY KEY (predictionid, position));
+CREATE TABLE IF NOT EXISTS predictionbets (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, predictionid INTEGER, userid TEXT, username TEXT, outcome INTEGER, amount BIGINT, placed TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS predictionpayouts (predictionid INTEGER, userid TEXT, username TEXT, amount BIGINT, reason TEXT, paid TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
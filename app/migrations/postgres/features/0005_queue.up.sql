@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS queue (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, userid TEXT UNIQUE, username TEXT, priority INTEGER DEFAULT 0, joined TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
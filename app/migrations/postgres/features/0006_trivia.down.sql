@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS triviascores;
+DROP TABLE IF EXISTS triviaquestions;
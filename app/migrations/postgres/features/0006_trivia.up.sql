@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS triviaquestions (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, category TEXT, question TEXT UNIQUE, answers TEXT);
+CREATE TABLE IF NOT EXISTS triviascores (season TEXT, userid TEXT, username TEXT, score INTEGER DEFAULT 0, PRIMARY KEY (season, userid));
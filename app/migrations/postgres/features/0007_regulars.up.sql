@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS regulars (username TEXT PRIMARY KEY, addedby TEXT, added TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
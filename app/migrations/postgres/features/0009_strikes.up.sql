@@ -0,0 +1,4 @@
+-- Offenses used to be counted in blocklistoffenses for a ladder of the blocklist's own, before the strike ladder
+-- took over. The counts aren't strikes, so they aren't carried over, and the down doesn't bring them back.
+DROP TABLE IF EXISTS blocklistoffenses;
+CREATE TABLE IF NOT EXISTS strikes (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, userid TEXT, username TEXT, reason TEXT, issuedby TEXT, created TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
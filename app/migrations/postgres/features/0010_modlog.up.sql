@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS modlog (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, action TEXT, userid TEXT, username TEXT, seconds INTEGER, messageid TEXT, message TEXT, moderator TEXT, reason TEXT, created TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
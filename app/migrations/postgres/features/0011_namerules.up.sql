@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS namerules (id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY, kind TEXT, pattern TEXT, action TEXT, addedby TEXT, added TIMESTAMP DEFAULT CURRENT_TIMESTAMP, UNIQUE (kind, pattern));
@@ -0,0 +1,3 @@
+-- Partitioned by day so old days can be dropped whole. The partitions are created as the days come.
+CREATE TABLE IF NOT EXISTS chatlog (sent TIMESTAMP NOT NULL, messageid TEXT, userid TEXT, username TEXT, message TEXT, tags JSONB, session TEXT) PARTITION BY RANGE (sent);
+CREATE INDEX IF NOT EXISTS chatlog_username ON chatlog (username, sent);
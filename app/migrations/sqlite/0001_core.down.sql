@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS quotes;
+DROP TABLE IF EXISTS channelusers;
+DROP TABLE IF EXISTS commands;
+DROP TABLE IF EXISTS broadcasters;
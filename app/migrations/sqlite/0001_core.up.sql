@@ -0,0 +1,5 @@
+-- Every channel's rows share these tables, told apart by the channel column.
+CREATE TABLE IF NOT EXISTS broadcasters (id INTEGER PRIMARY KEY, channelname TEXT UNIQUE, dbcreated BOOL, authorized BOOL);
+CREATE TABLE IF NOT EXISTS commands (id INTEGER PRIMARY KEY, channel TEXT NOT NULL, trigger TEXT, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER, cost INTEGER DEFAULT 0, UNIQUE (channel, trigger));
+CREATE TABLE IF NOT EXISTS channelusers (id INTEGER PRIMARY KEY, channel TEXT NOT NULL, name TEXT, aliases TEXT, lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT, UNIQUE (channel, name));
+CREATE TABLE IF NOT EXISTS quotes (channel TEXT NOT NULL, id INTEGER NOT NULL, quote TEXT, addedby TEXT, PRIMARY KEY (channel, id));
@@ -0,0 +1,14 @@
+CREATE TABLE commands_old (id INTEGER PRIMARY KEY, channel TEXT NOT NULL, trigger TEXT, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER, cost INTEGER DEFAULT 0, UNIQUE (channel, trigger));
+INSERT INTO commands_old (channel, trigger, payload, permission, cooldown, uses, cost) SELECT b.channelname, c.trigger, c.payload, c.permission, c.cooldown, c.uses, c.cost FROM commands c JOIN broadcasters b ON b.id = c.channel_id;
+DROP TABLE commands;
+ALTER TABLE commands_old RENAME TO commands;
+
+CREATE TABLE channelusers_old (id INTEGER PRIMARY KEY, channel TEXT NOT NULL, name TEXT, aliases TEXT, lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT, UNIQUE (channel, name));
+INSERT INTO channelusers_old (channel, name, aliases, lastseen, streamsvisited, watchtime, streamer, streamlink) SELECT b.channelname, u.name, u.aliases, u.lastseen, u.streamsvisited, u.watchtime, u.streamer, u.streamlink FROM channelusers u JOIN broadcasters b ON b.id = u.channel_id;
+DROP TABLE channelusers;
+ALTER TABLE channelusers_old RENAME TO channelusers;
+
+CREATE TABLE quotes_old (channel TEXT NOT NULL, id INTEGER NOT NULL, quote TEXT, addedby TEXT, PRIMARY KEY (channel, id));
+INSERT INTO quotes_old (channel, id, quote, addedby) SELECT b.channelname, q.id, q.quote, q.addedby FROM quotes q JOIN broadcasters b ON b.id = q.channel_id;
+DROP TABLE quotes;
+ALTER TABLE quotes_old RENAME TO quotes;
@@ -0,0 +1,16 @@
+-- Key channel rows by broadcasters id, as the shared Postgres tables do. Rows for a channel
+-- with no broadcasters row can't be keyed and are dropped.
+CREATE TABLE commands_new (id INTEGER PRIMARY KEY, channel_id INTEGER NOT NULL, trigger TEXT, payload TEXT, permission TEXT, cooldown INTEGER, uses INTEGER, cost INTEGER DEFAULT 0, UNIQUE (channel_id, trigger));
+INSERT INTO commands_new (channel_id, trigger, payload, permission, cooldown, uses, cost) SELECT b.id, c.trigger, c.payload, c.permission, c.cooldown, c.uses, c.cost FROM commands c JOIN broadcasters b ON b.channelname = c.channel;
+DROP TABLE commands;
+ALTER TABLE commands_new RENAME TO commands;
+
+CREATE TABLE channelusers_new (id INTEGER PRIMARY KEY, channel_id INTEGER NOT NULL, name TEXT, aliases TEXT, lastseen TEXT, streamsvisited INTEGER, watchtime INTEGER, streamer BOOL, streamlink TEXT, UNIQUE (channel_id, name));
+INSERT INTO channelusers_new (channel_id, name, aliases, lastseen, streamsvisited, watchtime, streamer, streamlink) SELECT b.id, u.name, u.aliases, u.lastseen, u.streamsvisited, u.watchtime, u.streamer, u.streamlink FROM channelusers u JOIN broadcasters b ON b.channelname = u.channel;
+DROP TABLE channelusers;
+ALTER TABLE channelusers_new RENAME TO channelusers;
+
+CREATE TABLE quotes_new (channel_id INTEGER NOT NULL, id INTEGER NOT NULL, quote TEXT, addedby TEXT, PRIMARY KEY (channel_id, id));
+INSERT INTO quotes_new (channel_id, id, quote, addedby) SELECT b.id, q.id, q.quote, q.addedby FROM quotes q JOIN broadcasters b ON b.channelname = q.channel;
+DROP TABLE quotes;
+ALTER TABLE quotes_new RENAME TO quotes;
@@ -0,0 +1,284 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+// roleRanks orders the roles used for filter exemptions, lowest first.
+var roleRanks = map[string]int{
+	"none":        0,
+	"viewer":      0,
+	"regular":     1,
+	"sub":         2,
+	"vip":         3,
+	"mod":         4,
+	"broadcaster": 5,
+}
+
+// permissionRanks maps ProcessUserPermissions levels onto roleRanks.
+var permissionRanks = map[string]int{
+	"v": 0,
+	"s": 2,
+	"i": 3,
+	"m": 4,
+	"b": 5,
+}
+
+// modAction is what the bot does about a message: warn, delete, timeout (for seconds) or ban.
+type modAction struct {
+	kind    string
+	seconds int
+}
+
+// filterHit is a filter's verdict on a message.
+type filterHit struct {
+	filter string
+	reason string
+	action modAction
+}
+
+// messageFilter inspects a chat message and returns a hit when it breaks the channel's rules.
+type messageFilter func(message twitch.PrivateMessage, ch broadcaster) *filterHit
+
+var (
+	// messageFilters is the moderation pipeline; filters register themselves from init.
+	messageFilters []messageFilter
+
+	regularsMutex sync.Mutex
+	regulars      = make(map[string]map[string]bool)
+)
+
+func init() {
+	settingDefaults["moderation.enabled"] = "true"
+}
+
+/* Roles */
+
+// UserRank places the chatter in the role hierarchy, counting the channel's regulars list.
+func UserRank(message twitch.PrivateMessage, ch broadcaster) int {
+	rank := permissionRanks[ProcessUserPermissions(message.User.Badges)]
+	if rank < roleRanks["regular"] && IsRegular(message.User.Name, ch) {
+		rank = roleRanks["regular"]
+	}
+	return rank
+}
+
+// filterExempt reports whether the chatter's role is at or above the filter's exemption level.
+// Mods and the broadcaster are never filtered.
+func filterExempt(filter string, message twitch.PrivateMessage, ch broadcaster) bool {
+	rank := UserRank(message, ch)
+	if rank >= roleRanks["mod"] {
+		return true
+	}
+	exempt, ok := roleRanks[SettingGet("filter."+filter+".exempt", ch.database)]
+	return ok && exempt > 0 && rank >= exempt
+}
+
+func validRole(value string) string {
+	if _, ok := roleRanks[strings.ToLower(value)]; !ok {
+		return "Exemptions are one of none, regular, sub, vip or mod."
+	}
+	return ""
+}
+
+/* Actions */
+
+func parseModAction(value string) (modAction, bool) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(value)), ":", 2)
+	action := modAction{kind: parts[0]}
+	switch action.kind {
+	case "warn", "delete", "ban":
+		return action, len(parts) == 1
+	case "timeout":
+		action.seconds = 600
+		if len(parts) == 2 {
+			seconds, err := strconv.Atoi(parts[1])
+			if err != nil || seconds < 1 || seconds > 1209600 {
+				return action, false
+			}
+			action.seconds = seconds
+		}
+		return action, true
+	}
+	return action, false
+}
+
+func validModAction(value string) string {
+	if _, ok := parseModAction(value); !ok {
+		return "Actions are warn, delete, timeout:<seconds> or ban."
+	}
+	return ""
+}
+
+func (a modAction) String() string {
+	if a.kind == "timeout" {
+		return fmt.Sprintf("timeout:%d", a.seconds)
+	}
+	return a.kind
+}
+
+// severity orders actions so the harshest verdict wins when several filters fire.
+func (a modAction) severity() int {
+	switch a.kind {
+	case "warn":
+		return 1
+	case "delete":
+		return 2
+	case "timeout":
+		return 3 + a.seconds
+	case "ban":
+		return 1 << 30
+	}
+	return 0
+}
+
+// removes reports whether the action takes the message out of chat.
+func (a modAction) removes() bool {
+	return a.kind == "delete" || a.kind == "timeout" || a.kind == "ban"
+}
+
+// filterAction reads a filter's configured action, falling back to its default if the setting is bad.
+func filterAction(filter string, ch broadcaster) modAction {
+	action, ok := parseModAction(SettingGet("filter."+filter+".action", ch.database))
+	if !ok {
+		zap.S().Errorf("Bad action for filter %v in %v, using the default", filter, ch.name)
+		action, _ = parseModAction(settingDefaults["filter."+filter+".action"])
+	}
+	return action
+}
+
+// ApplyModAction carries out an action against the message's author through chat commands.
+func ApplyModAction(action modAction, message twitch.PrivateMessage, reason string, ch broadcaster) {
+	zap.S().Infof("Moderation in %v: %v on %v for %v", ch.name, action, message.User.Name, reason)
+	if action.kind == "delete" && message.ID == "" {
+		return
+	}
+	noteBotAction(ch.name, message.User.Name, action.kind, reason)
+	var err error
+	switch action.kind {
+	case "warn":
+		err = SendChannelMessage(ch.name, fmt.Sprintf("@%s, please stop: %s", message.User.Name, reason))
+	case "delete":
+		err = SendChannelMessage(ch.name, "/delete "+message.ID)
+	case "timeout":
+		err = SendChannelMessage(ch.name, fmt.Sprintf("/timeout %s %d %s", message.User.Name, action.seconds, reason))
+	case "ban":
+		err = SendChannelMessage(ch.name, fmt.Sprintf("/ban %s %s", message.User.Name, reason))
+	}
+	if err != nil {
+		zap.S().Errorf("Couldn't %v %v in %v: %v", action.kind, message.User.Name, ch.name, err)
+	}
+}
+
+/* Pipeline */
+
+// ModerateMessage runs the message through every filter and applies the harshest verdict.
+// It reports whether the message was removed, in which case nothing else should act on it.
+func ModerateMessage(message twitch.PrivateMessage, ch broadcaster) bool {
+	if ch.database == nil || !SettingGetBool("moderation.enabled", ch.database) {
+		return false
+	}
+	var worst *filterHit
+	for _, filter := range messageFilters {
+		hit := filter(message, ch)
+		if hit != nil && (worst == nil || hit.action.severity() > worst.action.severity()) {
+			worst = hit
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	worst.action = strikeEscalate(worst, message, ch)
+	ApplyModAction(worst.action, message, worst.reason, ch)
+	return worst.action.removes()
+}
+
+/* Regulars Table */
+
+func loadRegulars(ch broadcaster) map[string]bool {
+	list := make(map[string]bool)
+	rows, err := ch.database.Query("SELECT username FROM regulars;")
+	if err != nil {
+		handleSQLError(err)
+		return list
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			list[name] = true
+		}
+	}
+	return list
+}
+
+// IsRegular checks the channel's regulars list, loading it on first use.
+func IsRegular(userName string, ch broadcaster) bool {
+	regularsMutex.Lock()
+	defer regularsMutex.Unlock()
+	if regulars[ch.name] == nil {
+		regulars[ch.name] = loadRegulars(ch)
+	}
+	return regulars[ch.name][strings.ToLower(userName)]
+}
+
+func regularsInvalidate(ch broadcaster) {
+	regularsMutex.Lock()
+	delete(regulars, ch.name)
+	regularsMutex.Unlock()
+}
+
+// RegularCommand handles !regular add|remove <user> and !regular list.
+func RegularCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		return "Usage: !regular add|remove <user>, or !regular list"
+	}
+	if fields[0] == "list" {
+		IsRegular("", ch)
+		regularsMutex.Lock()
+		names := make([]string, 0, len(regulars[ch.name]))
+		for name := range regulars[ch.name] {
+			names = append(names, name)
+		}
+		regularsMutex.Unlock()
+		if len(names) == 0 {
+			return "There are no regulars yet."
+		}
+		sort.Strings(names)
+		return "Regulars: " + strings.Join(names, ", ")
+	}
+	if len(fields) < 2 {
+		return "Usage: !regular add|remove <user>, or !regular list"
+	}
+	target := strings.TrimPrefix(fields[1], "@")
+
+	var err error
+	switch fields[0] {
+	case "add":
+		_, err = ch.database.Exec("INSERT INTO regulars (username, addedby) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING;", target, message.User.Name)
+	case "remove":
+		_, err = ch.database.Exec("DELETE FROM regulars WHERE username = $1;", target)
+	default:
+		return "Usage: !regular add|remove <user>, or !regular list"
+	}
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't change the regulars due to a SQL error."
+	}
+
+	regularsInvalidate(ch)
+	CacheNotify(ch.name, "moderation")
+	if fields[0] == "add" {
+		return target + " is now a regular."
+	}
+	return target + " is no longer a regular."
+}
@@ -0,0 +1,242 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+// historySize is how many recent messages per channel are kept to attach to moderation actions.
+const historySize = 500
+
+type historyEntry struct {
+	id       string
+	userID   string
+	userName string
+	text     string
+	at       time.Time
+}
+
+// history is a per-channel ring buffer of recent chat.
+type history struct {
+	entries []historyEntry
+	next    int
+}
+
+type pendingAction struct {
+	action string
+	reason string
+	at     time.Time
+}
+
+var (
+	historyMutex sync.Mutex
+	histories    = make(map[string]*history)
+	// botActions remembers why the bot itself just acted on a user, so the CLEARCHAT echo can say so.
+	botActions = make(map[string]pendingAction)
+)
+
+/* History */
+
+// HistoryRecord adds a chat message to the channel's history buffer.
+func HistoryRecord(message twitch.PrivateMessage) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	h, ok := histories[message.Channel]
+	if !ok {
+		h = &history{}
+		histories[message.Channel] = h
+	}
+	entry := historyEntry{id: message.ID, userID: message.User.ID, userName: message.User.Name, text: message.Message, at: time.Now()}
+	if len(h.entries) < historySize {
+		h.entries = append(h.entries, entry)
+	} else {
+		h.entries[h.next] = entry
+	}
+	h.next = (h.next + 1) % historySize
+}
+
+// historyFind searches the channel's history from newest to oldest for a matching message.
+func historyFind(channel string, match func(historyEntry) bool) (historyEntry, bool) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	h, ok := histories[channel]
+	if !ok {
+		return historyEntry{}, false
+	}
+	for i := 1; i <= len(h.entries); i++ {
+		entry := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if match(entry) {
+			return entry, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// noteBotAction remembers an action the bot is about to take, for its CLEARCHAT or CLEARMSG echo to claim.
+// Warnings don't produce one, so they aren't noted; a mod's own action soon after would be claimed instead.
+func noteBotAction(channel, userName, action, reason string) {
+	if action != "delete" && action != "timeout" && action != "ban" {
+		return
+	}
+	historyMutex.Lock()
+	botActions[channel+"/"+strings.ToLower(userName)] = pendingAction{action: action, reason: reason, at: time.Now()}
+	historyMutex.Unlock()
+}
+
+// takeBotAction returns the bot's reason if it took this action on the user in the last few seconds.
+func takeBotAction(channel, userName, action string) (string, bool) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	key := channel + "/" + strings.ToLower(userName)
+	pending, ok := botActions[key]
+	if !ok || pending.action != action {
+		return "", false
+	}
+	delete(botActions, key)
+	return pending.reason, time.Since(pending.at) < 30*time.Second
+}
+
+/* Modlog Table */
+
+func modlogInsert(ch broadcaster, action, userID, userName string, seconds int, messageID, text string) {
+	moderator, reason := "", ""
+	if userName != "" {
+		if botReason, ok := takeBotAction(ch.name, userName, action); ok {
+			moderator, reason = "bot", botReason
+		}
+	}
+	_, err := ch.database.Exec("INSERT INTO modlog (action, userid, username, seconds, messageid, message, moderator, reason) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+		action, userID, strings.ToLower(userName), seconds, messageID, text, moderator, reason)
+	if err != nil {
+		handleSQLError(err)
+	}
+}
+
+// ModlogClearChat records a ban, timeout or chat clear, attaching the user's last message from the history buffer.
+func ModlogClearChat(message twitch.ClearChatMessage, ch broadcaster) {
+	if message.TargetUsername == "" {
+		modlogInsert(ch, "clear", "", "", 0, "", "")
+		return
+	}
+	action := "ban"
+	if message.BanDuration > 0 {
+		action = "timeout"
+	}
+	last, _ := historyFind(ch.name, func(entry historyEntry) bool {
+		return entry.userID == message.TargetUserID || strings.EqualFold(entry.userName, message.TargetUsername)
+	})
+	modlogInsert(ch, action, message.TargetUserID, message.TargetUsername, message.BanDuration, last.id, last.text)
+}
+
+// ModlogClearMessage records a single deleted message.
+func ModlogClearMessage(message twitch.ClearMessage, ch broadcaster) {
+	found, _ := historyFind(ch.name, func(entry historyEntry) bool {
+		return entry.id == message.TargetMsgID
+	})
+	modlogInsert(ch, "delete", found.userID, message.Login, 0, message.TargetMsgID, message.Message)
+}
+
+/* Commands */
+
+type modlogEntry struct {
+	action    string
+	userID    string
+	userName  string
+	seconds   int
+	messageID string
+	message   string
+	moderator string
+	reason    string
+	created   time.Time
+}
+
+func modlogSelect(userName string, limit int, db *sql.DB) ([]modlogEntry, error) {
+	query := "SELECT action, userid, username, seconds, messageid, message, moderator, reason, created FROM modlog"
+	var args []interface{}
+	if userName != "" {
+		query += " WHERE username = $1"
+		args = append(args, strings.ToLower(userName))
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := db.Query(query+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []modlogEntry
+	for rows.Next() {
+		var e modlogEntry
+		if err := rows.Scan(&e.action, &e.userID, &e.userName, &e.seconds, &e.messageID, &e.message, &e.moderator, &e.reason, &e.created); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ModlogCommand handles !modlog <user>, showing their most recent moderation actions.
+func ModlogCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return "Usage: !modlog <user>"
+	}
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	entries, err := modlogSelect(target, 5, ch.database)
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't read the modlog due to a SQL error."
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("%s has a clean modlog.", target)
+	}
+
+	var parts []string
+	for _, e := range entries {
+		part := e.created.Format("2006-01-02") + " " + e.action
+		if e.action == "timeout" {
+			part += fmt.Sprintf(" %ds", e.seconds)
+		}
+		if e.moderator != "" {
+			part += " by " + e.moderator
+		}
+		if e.message != "" {
+			text := e.message
+			if runes := []rune(text); len(runes) > 60 {
+				text = string(runes[:57]) + "..."
+			}
+			part += fmt.Sprintf(" (%q)", text)
+		}
+		parts = append(parts, part)
+	}
+	// The entries quote what was removed, which chat mustn't see again, so they only go to the mod who asked.
+	whisperMod(message.User.Name, fmt.Sprintf("%s: %s", target, strings.Join(parts, "; ")))
+	return fmt.Sprintf("%s has %d recent modlog entries, I've whispered them to {user}.", target, len(entries))
+}
+
+// ModlogExport writes the channel's modlog as CSV, optionally for one user, for handling appeals.
+func ModlogExport(userName string, db *sql.DB, w io.Writer) error {
+	entries, err := modlogSelect(userName, 0, db)
+	if err != nil {
+		return err
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"created", "action", "userid", "username", "seconds", "messageid", "message", "moderator", "reason"})
+	for _, e := range entries {
+		out.Write([]string{e.created.UTC().Format(time.RFC3339), e.action, e.userID, e.userName, strconv.Itoa(e.seconds), e.messageID, e.message, e.moderator, e.reason})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,350 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["namerules.enabled"] = "true"
+	settingDefaults["namerules.dryrun"] = "true"
+	settingDefaults["namerules.distance"] = "2"
+}
+
+// nameRule matches usernames by regex, or by similarity to an example name like hoss00312_1.
+type nameRule struct {
+	id       int64
+	kind     string
+	pattern  string
+	action   modAction
+	regex    *regexp.Regexp
+	skeleton string
+}
+
+var (
+	nameRulesMutex sync.Mutex
+	nameRules      = make(map[string][]*nameRule)
+	// checkedNames is every chatter's name already run past the channel's rules.
+	checkedNames = make(map[string]map[string]bool)
+	// joinedNames is the same for JOINs, so JOIN waves don't repeat work.
+	joinedNames = make(map[string]map[string]bool)
+	// nameReports batches matches that weren't actioned into one whisper to the mods.
+	nameReports = make(map[string][]string)
+	// channelRoles caches each channel's mods and VIPs from Helix, since JOINs carry no badges to check.
+	channelRoles = make(map[string]roleList)
+)
+
+// roleList is a channel's mods and VIPs as of fetched. names is nil when Helix couldn't say.
+type roleList struct {
+	names   map[string]bool
+	fetched time.Time
+}
+
+// nameSkeleton replaces each run of digits with # so numbered bot names share a shape.
+func nameSkeleton(name string) string {
+	var b strings.Builder
+	inDigits := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsDigit(r) {
+			if !inDigits {
+				b.WriteRune('#')
+			}
+			inDigits = true
+			continue
+		}
+		inDigits = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (r *nameRule) matches(name string, distance int) bool {
+	name = strings.ToLower(name)
+	if r.kind == "regex" {
+		return r.regex != nil && r.regex.MatchString(name)
+	}
+	if nameSkeleton(name) == r.skeleton {
+		return true
+	}
+	// Short examples would match half of chat within a couple of edits.
+	return len(r.pattern) >= 3*distance && levenshtein(name, r.pattern) <= distance
+}
+
+/* Name Rules Table */
+
+func loadNameRules(db *sql.DB) []*nameRule {
+	rows, err := db.Query("SELECT id, kind, pattern, action FROM namerules ORDER BY id;")
+	if err != nil {
+		handleSQLError(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var rules []*nameRule
+	for rows.Next() {
+		var (
+			rule   nameRule
+			action string
+		)
+		if err := rows.Scan(&rule.id, &rule.kind, &rule.pattern, &action); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		rule.action, _ = parseModAction(action)
+		if rule.kind == "regex" {
+			if rule.regex, err = regexp.Compile("(?i)" + rule.pattern); err != nil {
+				zap.S().Errorf("Skipping bad name rule %v: %v", rule.pattern, err)
+				continue
+			}
+		}
+		rule.skeleton = nameSkeleton(rule.pattern)
+		rules = append(rules, &rule)
+	}
+	return rules
+}
+
+// channelNameRules returns the channel's rules, loading them on first use. Callers hold nameRulesMutex.
+func channelNameRules(ch broadcaster) []*nameRule {
+	rules, ok := nameRules[ch.name]
+	if !ok {
+		rules = loadNameRules(ch.database)
+		nameRules[ch.name] = rules
+	}
+	return rules
+}
+
+func nameRulesInvalidate(ch broadcaster) {
+	nameRulesMutex.Lock()
+	delete(nameRules, ch.name)
+	delete(checkedNames, ch.name)
+	delete(joinedNames, ch.name)
+	nameRulesMutex.Unlock()
+}
+
+func matchNameRule(name string, ch broadcaster) *nameRule {
+	distance := SettingGetInt("namerules.distance", ch.database)
+	nameRulesMutex.Lock()
+	defer nameRulesMutex.Unlock()
+	for _, rule := range channelNameRules(ch) {
+		if rule.matches(name, distance) {
+			return rule
+		}
+	}
+	return nil
+}
+
+/* Enforcement */
+
+// NameRuleJoin runs a joining username past the channel's rules. A JOIN says nothing about the user's badges,
+// so mods and VIPs are exempted by the channel's role list. A match is enforced unless in dry-run mode, and only
+// reported to the mods when the role list couldn't be fetched or the action needs a message to act on.
+func NameRuleJoin(userName string, ch broadcaster) {
+	if ch.database == nil || !SettingGetBool("namerules.enabled", ch.database) {
+		return
+	}
+	userName = strings.ToLower(userName)
+	nameRulesMutex.Lock()
+	seen := markSeen(joinedNames, ch.name, userName)
+	nameRulesMutex.Unlock()
+	if seen || userName == ch.name {
+		return
+	}
+	rule := matchNameRule(userName, ch)
+	if rule == nil {
+		return
+	}
+	// Fetching the role list can take a while, and the IRC client waits on its handlers.
+	go func() {
+		roles, known := channelRoleNames(ch)
+		switch {
+		case roles[userName]:
+			// Mods and VIPs are left alone.
+		case SettingGetBool("namerules.dryrun", ch.database):
+			reportNameMatch(fmt.Sprintf("%s joined (#%d, %s, dry run)", userName, rule.id, rule.action), ch)
+		case !known:
+			reportNameMatch(fmt.Sprintf("%s joined (#%d, %s, couldn't check their role)", userName, rule.id, rule.action), ch)
+		case rule.action.kind != "timeout" && rule.action.kind != "ban":
+			reportNameMatch(fmt.Sprintf("%s joined (#%d, %s)", userName, rule.id, rule.action), ch)
+		default:
+			ApplyModAction(rule.action, twitch.PrivateMessage{User: twitch.User{Name: userName}}, "username matches a banned pattern", ch)
+		}
+	}()
+}
+
+// channelRoleNames returns everyone with a role in the channel: the mods and VIPs from Helix, refreshed every
+// ten minutes, plus the mods seen in chat. known is false when Helix couldn't be asked.
+func channelRoleNames(ch broadcaster) (names map[string]bool, known bool) {
+	nameRulesMutex.Lock()
+	list, ok := channelRoles[ch.name]
+	nameRulesMutex.Unlock()
+	// A failed fetch is retried sooner, but not on every JOIN of a wave.
+	if !ok || time.Since(list.fetched) > 10*time.Minute || (list.names == nil && time.Since(list.fetched) > time.Minute) {
+		list = roleList{fetched: time.Now()}
+		id, err := HelixUserID(ch.name)
+		if err == nil && id != "" {
+			list.names, err = HelixChannelRoles(id)
+		}
+		if err != nil {
+			zap.S().Errorf("Couldn't fetch the mods and VIPs of %v: %v", ch.name, err)
+		}
+		nameRulesMutex.Lock()
+		channelRoles[ch.name] = list
+		nameRulesMutex.Unlock()
+	}
+
+	names = make(map[string]bool)
+	for name := range list.names {
+		names[name] = true
+	}
+	newChattersMutex.Lock()
+	for mod := range channelMods[ch.name] {
+		names[mod] = true
+	}
+	newChattersMutex.Unlock()
+	return names, list.names != nil
+}
+
+// NameRuleSpeak checks a chatter's name the first time they talk, skipping anyone with a role.
+// In dry-run mode matches are only reported to the mods. It reports whether the user was actioned.
+func NameRuleSpeak(message twitch.PrivateMessage, ch broadcaster) bool {
+	if ch.database == nil || !SettingGetBool("namerules.enabled", ch.database) || UserRank(message, ch) > roleRanks["viewer"] {
+		return false
+	}
+	userName := strings.ToLower(message.User.Name)
+	nameRulesMutex.Lock()
+	seen := markSeen(checkedNames, ch.name, userName)
+	nameRulesMutex.Unlock()
+	if seen || userName == ch.name {
+		return false
+	}
+
+	rule := matchNameRule(userName, ch)
+	if rule == nil {
+		return false
+	}
+	if SettingGetBool("namerules.dryrun", ch.database) {
+		reportNameMatch(fmt.Sprintf("%s (#%d, %s, dry run)", userName, rule.id, rule.action), ch)
+		return false
+	}
+	ApplyModAction(rule.action, message, "username matches a banned pattern", ch)
+	return rule.action.removes()
+}
+
+// reportNameMatch queues a match that wasn't actioned and whispers the mods the batch a little later.
+func reportNameMatch(match string, ch broadcaster) {
+	nameRulesMutex.Lock()
+	defer nameRulesMutex.Unlock()
+	nameReports[ch.name] = append(nameReports[ch.name], match)
+	if len(nameReports[ch.name]) > 1 {
+		return
+	}
+	time.AfterFunc(15*time.Second, func() {
+		nameRulesMutex.Lock()
+		matches := nameReports[ch.name]
+		delete(nameReports, ch.name)
+		nameRulesMutex.Unlock()
+
+		notice := fmt.Sprintf("Name rules in %s matched, nobody was actioned: %s", ch.name, strings.Join(matches, ", "))
+		WhisperMods(ch, truncateMessage(notice))
+	})
+}
+
+/* Commands */
+
+// NameRuleCommand handles !namerule add <regex|similar> <pattern> [action=<action>], remove <id>, list and test <name>.
+func NameRuleCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	usage := "Usage: !namerule add <regex|similar> <pattern> [action=<action>], !namerule remove <id>, !namerule list, !namerule test <name>"
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return usage
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "add":
+		if len(fields) < 3 {
+			return usage
+		}
+		kind, pattern := strings.ToLower(fields[1]), fields[2]
+		if kind != "regex" && kind != "similar" {
+			return "Name rules are a regex or similar to an example name."
+		}
+		if kind == "similar" {
+			pattern = strings.ToLower(strings.TrimPrefix(pattern, "@"))
+		} else if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Sprintf("That regex doesn't compile: %v", err)
+		}
+		action := modAction{kind: "ban"}
+		if len(fields) > 3 && strings.HasPrefix(strings.ToLower(fields[3]), "action=") {
+			var ok bool
+			if action, ok = parseModAction(fields[3][len("action="):]); !ok {
+				return validModAction(fields[3][len("action="):])
+			}
+		}
+		var id int64
+		err := ch.database.QueryRow("INSERT INTO namerules (kind, pattern, action, addedby) VALUES ($1, $2, $3, $4) ON CONFLICT (kind, pattern) DO UPDATE SET action = EXCLUDED.action RETURNING id;", kind, pattern, action.String(), message.User.Name).Scan(&id)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't add that name rule due to a SQL error."
+		}
+		nameRulesInvalidate(ch)
+		CacheNotify(ch.name, "moderation")
+		mode := "enforced"
+		if SettingGetBool("namerules.dryrun", ch.database) {
+			mode = "dry run, set namerules.dryrun to false to enforce"
+		}
+		return fmt.Sprintf("Name rule #%d added (%s, %s).", id, action, mode)
+	case "remove":
+		if len(fields) < 2 {
+			return usage
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(fields[1], "#"), 10, 64)
+		if err != nil {
+			return "Remove name rules by their number from !namerule list."
+		}
+		res, err := ch.database.Exec("DELETE FROM namerules WHERE id = $1;", id)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't remove that due to a SQL error."
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Sprintf("There's no name rule #%d.", id)
+		}
+		nameRulesInvalidate(ch)
+		CacheNotify(ch.name, "moderation")
+		return fmt.Sprintf("Name rule #%d removed.", id)
+	case "list":
+		nameRulesMutex.Lock()
+		var parts []string
+		for _, rule := range channelNameRules(ch) {
+			parts = append(parts, fmt.Sprintf("#%d %s:%s (%s)", rule.id, rule.kind, rule.pattern, rule.action))
+		}
+		nameRulesMutex.Unlock()
+		if len(parts) == 0 {
+			return "There are no name rules."
+		}
+		result := "Name rules: " + strings.Join(parts, ", ")
+		result = truncateMessage(result)
+		return result
+	case "test":
+		if len(fields) < 2 {
+			return usage
+		}
+		rule := matchNameRule(strings.TrimPrefix(fields[1], "@"), ch)
+		if rule == nil {
+			return "That name doesn't match any rule."
+		}
+		return fmt.Sprintf("That name matches #%d %s:%s (%s).", rule.id, rule.kind, rule.pattern, rule.action)
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,166 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["newchatters.welcome"] = ""
+	settingDefaults["newchatters.scrutinymessages"] = "5"
+	settingDefaults["newchatters.strictness"] = "50"
+	settingDefaults["newchatters.linkwhisper"] = "true"
+}
+
+var (
+	newChattersMutex sync.Mutex
+	// newChatters counts messages from chatters seen for the first time, until they're past scrutiny.
+	newChatters = make(map[string]map[string]int)
+	// knownChatters saves a channelusers lookup for everyone already checked recently.
+	knownChatters = make(map[string]map[string]bool)
+	// channelMods are the mods seen in chat, who get whispered about new chatters' links.
+	channelMods = make(map[string]map[string]bool)
+)
+
+// seenLimit caps each channel's set of chatters already looked at. Past it the set starts over, which costs
+// a few repeat lookups rather than memory that grows for as long as the bot runs.
+const seenLimit = 10000
+
+// markSeen adds key to the channel's set and reports whether it was already there. Callers hold the set's lock.
+func markSeen(sets map[string]map[string]bool, channel, key string) bool {
+	set := sets[channel]
+	if set == nil || len(set) >= seenLimit {
+		set = make(map[string]bool)
+		sets[channel] = set
+	}
+	seen := set[key]
+	set[key] = true
+	return seen
+}
+
+// firstMessage reports whether this is the chatter's first message in the channel. Twitch's first-msg tag
+// decides when it's there; otherwise the channelusers table does, and the chatter is added to it.
+func firstMessage(message twitch.PrivateMessage, ch broadcaster) bool {
+	newChattersMutex.Lock()
+	known := markSeen(knownChatters, ch.name, message.User.ID)
+	newChattersMutex.Unlock()
+	if known {
+		return false
+	}
+
+	var first bool
+	if tag, ok := message.Tags["first-msg"]; ok {
+		first = tag == "1"
+	} else {
+		_, err := ch.store.User(message.User.Name)
+		if err != nil && err != sql.ErrNoRows {
+			handleSQLError(err)
+			return false
+		}
+		first = err == sql.ErrNoRows
+	}
+	if first {
+		UserTableInsert(channelUser{name: message.User.Name, lastSeen: time.Now().UTC().Format(time.RFC3339), streamsVisited: 1}, ch.store)
+	}
+	return first
+}
+
+// NewChatterTrack notes mods and first-time chatters before the message is moderated, and whispers mods
+// when a chatter under scrutiny posts a link. It reports whether this is the chatter's first message.
+func NewChatterTrack(message twitch.PrivateMessage, ch broadcaster) bool {
+	level := ProcessUserPermissions(message.User.Badges)
+	newChattersMutex.Lock()
+	if level == "m" || level == "b" {
+		if channelMods[ch.name] == nil {
+			channelMods[ch.name] = make(map[string]bool)
+		}
+		channelMods[ch.name][message.User.Name] = true
+	}
+	newChattersMutex.Unlock()
+
+	first := firstMessage(message, ch)
+	newChattersMutex.Lock()
+	if newChatters[ch.name] == nil {
+		newChatters[ch.name] = make(map[string]int)
+	}
+	if first {
+		newChatters[ch.name][message.User.ID] = 1
+	} else if count, ok := newChatters[ch.name][message.User.ID]; ok {
+		if count >= SettingGetInt("newchatters.scrutinymessages", ch.database) {
+			delete(newChatters[ch.name], message.User.ID)
+		} else {
+			newChatters[ch.name][message.User.ID] = count + 1
+		}
+	}
+	newChattersMutex.Unlock()
+
+	if IsNewChatter(message, ch) && SettingGetBool("newchatters.linkwhisper", ch.database) {
+		if links := MessageLinks(message.Message); len(links) > 0 {
+			WhisperMods(ch, fmt.Sprintf("New chatter %s posted a link in %s: %s", message.User.Name, ch.name, strings.Join(links, ", ")))
+		}
+	}
+	return first
+}
+
+// WhisperMods sends a notice to every mod seen in the channel's chat, and the broadcaster.
+func WhisperMods(ch broadcaster, notice string) {
+	if CLIENT == nil {
+		return
+	}
+	newChattersMutex.Lock()
+	mods := map[string]bool{ch.name: true}
+	for mod := range channelMods[ch.name] {
+		mods[mod] = true
+	}
+	newChattersMutex.Unlock()
+	for mod := range mods {
+		CLIENT.Whisper(mod, notice)
+	}
+}
+
+// whisperMod sends a mod something that shouldn't go to chat, such as the terms on the blocklist.
+func whisperMod(mod, text string) {
+	if CLIENT == nil {
+		return
+	}
+	CLIENT.Whisper(mod, truncateMessage(text))
+}
+
+// IsNewChatter reports whether the chatter is still within their first scrutinymessages messages.
+func IsNewChatter(message twitch.PrivateMessage, ch broadcaster) bool {
+	newChattersMutex.Lock()
+	defer newChattersMutex.Unlock()
+	count, ok := newChatters[ch.name][message.User.ID]
+	return ok && count <= SettingGetInt("newchatters.scrutinymessages", ch.database)
+}
+
+// NewChatterWelcome posts the channel's welcome template, if it has one, for a first-time chatter.
+func NewChatterWelcome(message twitch.PrivateMessage, ch broadcaster) {
+	template := SettingGet("newchatters.welcome", ch.database)
+	if template == "" {
+		return
+	}
+	zap.S().Infof("Welcoming %v to %v", message.User.Name, ch.name)
+	if err := SendChannelMessage(ch.name, FormatResponse(template, message)); err != nil {
+		zap.S().Errorf("Couldn't welcome %v in %v: %v", message.User.Name, ch.name, err)
+	}
+}
+
+// newChatterThreshold tightens a filter threshold for chatters under scrutiny. Zero still means off.
+func newChatterThreshold(value int, message twitch.PrivateMessage, ch broadcaster) int {
+	if value <= 0 || !IsNewChatter(message, ch) {
+		return value
+	}
+	value = value * SettingGetInt("newchatters.strictness", ch.database) / 100
+	if value < 1 {
+		value = 1
+	}
+	return value
+}
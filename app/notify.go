@@ -0,0 +1,177 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// When more than one bot runs against the same database, a change made through one has to reach the others'
+// caches. Every change sends a NOTIFY on the bot DB, which every instance LISTENs to. Notifications are lost
+// while the listening connection is down, so until it's back, and once when it is, caches are dropped on a timer.
+
+// cacheEvents is the Postgres notification channel for cache invalidation.
+const cacheEvents = "bot_cache"
+
+// cacheReconcileInterval is how often caches are dropped while notifications can't be trusted.
+const cacheReconcileInterval = time.Minute
+
+// cacheEvent says which of a channel's caches changed. Instance lets the sender skip its own changes.
+type cacheEvent struct {
+	Instance string `json:"instance"`
+	Channel  string `json:"channel"`
+	Entity   string `json:"entity"`
+}
+
+// cacheListener is a store whose database can carry notifications between instances.
+type cacheListener interface {
+	listenURL() string
+}
+
+func (s postgresStore) listenURL() string {
+	return dbURL(s.endpoint, s.user, s.password, s.name, nil)
+}
+
+var (
+	// instanceID tells this process's notifications from other instances'.
+	instanceID = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+	cacheNotifyMutex sync.Mutex
+	// cacheNotifying is set once the bot is listening, so there's someone to notify.
+	cacheNotifying bool
+)
+
+// channelForDB finds the channel that uses db, for code that only has the channel's database.
+func channelForDB(db *sql.DB) string {
+	for name, ch := range channels {
+		if db != nil && ch.database == db {
+			return name
+		}
+	}
+	return ""
+}
+
+// cacheNotifyStart turns notifications on, once there's a listener, or for a command line change that running bots need to hear about.
+func cacheNotifyStart() {
+	cacheNotifyMutex.Lock()
+	cacheNotifying = true
+	cacheNotifyMutex.Unlock()
+}
+
+// CacheNotify tells the other instances that one of a channel's cached entities changed.
+func CacheNotify(channel, entity string) {
+	cacheNotifyMutex.Lock()
+	notifying := cacheNotifying
+	cacheNotifyMutex.Unlock()
+	// pg_notify is Postgres-only, and a SQLite store has no other instances to tell.
+	if !notifying || channel == "" || !botDBPostgres() {
+		return
+	}
+	payload, err := json.Marshal(cacheEvent{Instance: instanceID, Channel: channel, Entity: entity})
+	if err != nil {
+		return
+	}
+	if _, err := BOTDB.Exec("SELECT pg_notify($1, $2);", cacheEvents, string(payload)); err != nil {
+		handleSQLError(err)
+	}
+}
+
+// cacheInvalidate drops the caches an event names.
+func cacheInvalidate(event cacheEvent) {
+	ch, ok := channels[event.Channel]
+	if !ok {
+		return
+	}
+	zap.S().Debugf("%v changed in %v on another instance", event.Entity, event.Channel)
+	switch event.Entity {
+	case "command":
+		commandCacheInvalidate(ch.name)
+	case "settings":
+		settingsInvalidate(ch.database)
+	case "moderation":
+		regularsInvalidate(ch)
+		blocklistInvalidate(ch)
+		nameRulesInvalidate(ch)
+	case "quote":
+		// Quotes are read from the database every time, so there's nothing to drop.
+	}
+}
+
+// cacheReconcile drops every channel's caches, for when notifications may have been missed.
+// It covers the same caches as cacheInvalidate, so keep the two in step.
+func cacheReconcile() {
+	for name, ch := range channels {
+		commandCacheInvalidate(name)
+		settingsInvalidate(ch.database)
+		regularsInvalidate(ch)
+		blocklistInvalidate(ch)
+		nameRulesInvalidate(ch)
+	}
+}
+
+// CacheListen follows the other instances' changes until the bot exits.
+func CacheListen(url string) {
+	var (
+		healthMutex sync.Mutex
+		healthy     bool
+	)
+	setHealthy := func(value bool) {
+		healthMutex.Lock()
+		healthy = value
+		healthMutex.Unlock()
+	}
+	listener := pq.NewListener(url, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			setHealthy(true)
+		case pq.ListenerEventDisconnected:
+			zap.S().Errorf("Lost the cache notification connection, reconciling every %v until it's back: %v", cacheReconcileInterval, err)
+			setHealthy(false)
+		case pq.ListenerEventConnectionAttemptFailed:
+			setHealthy(false)
+		case pq.ListenerEventReconnected:
+			zap.S().Info("Cache notifications are back")
+			setHealthy(true)
+		}
+	})
+	if err := listener.Listen(cacheEvents); err != nil {
+		zap.S().Errorf("Couldn't listen for cache notifications, reconciling every %v instead: %v", cacheReconcileInterval, err)
+	}
+	cacheNotifyStart()
+
+	ticker := time.NewTicker(cacheReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// lib/pq sends nil after reconnecting, when anything sent in the gap is gone.
+				cacheReconcile()
+				continue
+			}
+			var event cacheEvent
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				zap.S().Errorf("Ignoring a cache notification I can't read: %v", notification.Extra)
+				continue
+			}
+			if event.Instance != instanceID {
+				cacheInvalidate(event)
+			}
+		case <-ticker.C:
+			healthMutex.Lock()
+			ok := healthy
+			healthMutex.Unlock()
+			if !ok {
+				cacheReconcile()
+			}
+			go listener.Ping()
+		}
+	}
+}
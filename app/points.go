@@ -0,0 +1,360 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	errInsufficientPoints = errors.New("insufficient points")
+	errUnknownViewer      = errors.New("unknown viewer")
+)
+
+func init() {
+	settingDefaults["points.name"] = "points"
+	settingDefaults["points.interval"] = "5"
+	settingDefaults["points.payout"] = "10"
+	settingDefaults["points.submultiplier"] = "2"
+	settingDefaults["points.vipmultiplier"] = "1.5"
+	settingDefaults["points.bitsrate"] = "1"
+}
+
+// chatter is a viewer the bot has seen talking recently, used for watchtime payouts.
+type chatter struct {
+	userID     string
+	userName   string
+	multiplier float64
+	seen       time.Time
+}
+
+var (
+	presenceMutex sync.Mutex
+	presence      = make(map[string]map[string]*chatter)
+)
+
+type pointsEntry struct {
+	userName string
+	balance  int64
+}
+
+/* Points Tables */
+
+// PointsAdjust changes a viewer's balance by delta and records it in the ledger.
+// A debit that would take the balance below zero fails with errInsufficientPoints.
+func PointsAdjust(tx *sql.Tx, userID, userName string, delta int64, reason string) (int64, error) {
+	if delta >= 0 {
+		_, err := tx.Exec("INSERT INTO points (userid, username, balance) VALUES ($1, $2, $3) ON CONFLICT (userid) DO UPDATE SET balance = points.balance + EXCLUDED.balance, username = EXCLUDED.username;", userID, userName, delta)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		res, err := tx.Exec("UPDATE points SET balance = balance + $1 WHERE userid = $2 AND balance + $1 >= 0;", delta, userID)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return 0, err
+		} else if n == 0 {
+			return 0, errInsufficientPoints
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO pointsledger (userid, delta, reason) VALUES ($1, $2, $3);", userID, delta, reason); err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	err := tx.QueryRow("SELECT balance FROM points WHERE userid = $1;", userID).Scan(&balance)
+	return balance, err
+}
+
+func PointsBalance(userID string, db *sql.DB) int64 {
+	var balance int64
+	err := db.QueryRow("SELECT balance FROM points WHERE userid = $1;", userID).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		handleSQLError(err)
+	}
+	return balance
+}
+
+// PointsLookup finds the user-id and current balance of a viewer by login name.
+func PointsLookup(userName string, db *sql.DB) (string, int64, error) {
+	var (
+		userID  string
+		balance int64
+	)
+	err := db.QueryRow("SELECT userid, balance FROM points WHERE username = $1;", strings.ToLower(userName)).Scan(&userID, &balance)
+	if err == sql.ErrNoRows {
+		return "", 0, errUnknownViewer
+	}
+	return userID, balance, err
+}
+
+func PointsTop(limit int, db *sql.DB) []pointsEntry {
+	rows, err := db.Query("SELECT username, balance FROM points ORDER BY balance DESC LIMIT $1;", limit)
+	if err != nil {
+		handleSQLError(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []pointsEntry
+	for rows.Next() {
+		var entry pointsEntry
+		if err := rows.Scan(&entry.userName, &entry.balance); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+/* Earning */
+
+func pointsMultiplier(badges map[string]int, db *sql.DB) float64 {
+	multiplier := 1.0
+	if badges["subscriber"] > 0 || badges["founder"] > 0 {
+		if m := SettingGetFloat("points.submultiplier", db); m > multiplier {
+			multiplier = m
+		}
+	}
+	if badges["vip"] > 0 {
+		if m := SettingGetFloat("points.vipmultiplier", db); m > multiplier {
+			multiplier = m
+		}
+	}
+	return multiplier
+}
+
+// PointsTrackChatter marks the viewer as present for watchtime and pays out any bits they cheered.
+func PointsTrackChatter(message twitch.PrivateMessage, ch broadcaster) {
+	if message.User.ID == "" {
+		return
+	}
+	multiplier := pointsMultiplier(message.User.Badges, ch.database)
+
+	presenceMutex.Lock()
+	if presence[ch.name] == nil {
+		presence[ch.name] = make(map[string]*chatter)
+	}
+	presence[ch.name][message.User.ID] = &chatter{
+		userID:     message.User.ID,
+		userName:   message.User.Name,
+		multiplier: multiplier,
+		seen:       time.Now(),
+	}
+	presenceMutex.Unlock()
+
+	bits := ProcessUserBits(message.Tags)
+	if bits <= 0 {
+		return
+	}
+	bonus := int64(float64(bits) * SettingGetFloat("points.bitsrate", ch.database))
+	if bonus <= 0 {
+		return
+	}
+	err := WithTx(ch.database, func(tx *sql.Tx) error {
+		_, err := PointsAdjust(tx, message.User.ID, message.User.Name, bonus, fmt.Sprintf("bits:%d", bits))
+		return err
+	})
+	if err != nil {
+		handleSQLError(err)
+	}
+}
+
+// pointsPayoutRound credits everyone present in the channel with one interval of watchtime.
+func pointsPayoutRound(ch broadcaster, window time.Duration) {
+	payout := float64(SettingGetInt("points.payout", ch.database))
+	cutoff := time.Now().Add(-window)
+
+	credited := make(map[string]bool)
+	var due []chatter
+	presenceMutex.Lock()
+	for id, c := range presence[ch.name] {
+		if c.seen.Before(cutoff) {
+			delete(presence[ch.name], id)
+			continue
+		}
+		due = append(due, *c)
+		credited[c.userName] = true
+	}
+	presenceMutex.Unlock()
+
+	// Lurkers only show up in the membership list, so credit the ones we already have a user-id for.
+	if CLIENT != nil {
+		userlist, err := CLIENT.Userlist(ch.name)
+		if err != nil {
+			zap.S().Debugf("No userlist for %v: %v", ch.name, err)
+		}
+		for _, name := range userlist {
+			name = strings.ToLower(name)
+			if credited[name] {
+				continue
+			}
+			userID, _, err := PointsLookup(name, ch.database)
+			if err != nil {
+				continue
+			}
+			due = append(due, chatter{userID: userID, userName: name, multiplier: 1})
+		}
+	}
+
+	for _, c := range due {
+		amount := int64(payout * c.multiplier)
+		if amount <= 0 {
+			continue
+		}
+		err := WithTx(ch.database, func(tx *sql.Tx) error {
+			_, err := PointsAdjust(tx, c.userID, c.userName, amount, "watchtime")
+			return err
+		})
+		if err != nil {
+			handleSQLError(err)
+		}
+	}
+	zap.S().Debugf("Paid watchtime to %d viewers in %v", len(due), ch.name)
+}
+
+/* GoRoutines - Subprocesses */
+
+func pointsPayout(ch broadcaster) {
+	for ch.connected {
+		interval := time.Duration(SettingGetInt("points.interval", ch.database)) * time.Minute
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		time.Sleep(interval)
+
+		live, err := HelixStreamLive(ch.name)
+		if err != nil {
+			zap.S().Debugf("Couldn't check if %v is live: %v", ch.name, err)
+			continue
+		}
+		if live {
+			pointsPayoutRound(ch, 2*interval)
+		}
+	}
+}
+
+/* Commands */
+
+func parsePointsTarget(options string) (string, int64, error) {
+	fields := strings.Fields(options)
+	if len(fields) < 2 {
+		return "", 0, errors.New("missing target or amount")
+	}
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	amount, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return "", 0, errors.New("invalid amount")
+	}
+	return target, amount, nil
+}
+
+func PointsCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	target := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(options), "@"))
+	if target == "" || target == message.User.Name {
+		return fmt.Sprintf("{user} has %d %s.", PointsBalance(message.User.ID, ch.database), name)
+	}
+	_, balance, err := PointsLookup(target, ch.database)
+	if err == errUnknownViewer {
+		return fmt.Sprintf("%s doesn't have any %s yet.", target, name)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't look that up due to a SQL error."
+	}
+	return fmt.Sprintf("%s has %d %s.", target, balance, name)
+}
+
+func PointsGiveCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	target, amount, err := parsePointsTarget(options)
+	if err != nil {
+		return "Usage: !give <user> <amount>"
+	}
+	if target == message.User.Name {
+		return fmt.Sprintf("You can't give %s to yourself {user}.", name)
+	}
+	targetID, _, err := PointsLookup(target, ch.database)
+	if err == errUnknownViewer {
+		return fmt.Sprintf("I haven't seen %s in chat yet.", target)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't do that due to a SQL error."
+	}
+
+	err = WithTx(ch.database, func(tx *sql.Tx) error {
+		if _, err := PointsAdjust(tx, message.User.ID, message.User.Name, -amount, "give:"+target); err != nil {
+			return err
+		}
+		_, err := PointsAdjust(tx, targetID, target, amount, "give:"+message.User.Name)
+		return err
+	})
+	if err == errInsufficientPoints {
+		return fmt.Sprintf("Sorry {user}, you don't have %d %s.", amount, name)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't do that due to a SQL error."
+	}
+	return fmt.Sprintf("{user} gave %d %s to %s.", amount, name, target)
+}
+
+// PointsModCommand handles !addpoints and !removepoints; sign is +1 or -1.
+func PointsModCommand(message twitch.PrivateMessage, options string, sign int64, ch broadcaster) string {
+	name := SettingGet("points.name", ch.database)
+	target, amount, err := parsePointsTarget(options)
+	if err != nil {
+		return "Usage: !addpoints <user> <amount> or !removepoints <user> <amount>"
+	}
+	targetID, balance, err := PointsLookup(target, ch.database)
+	if err == errUnknownViewer {
+		return fmt.Sprintf("I haven't seen %s in chat yet.", target)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't do that due to a SQL error."
+	}
+
+	var newBalance int64
+	err = WithTx(ch.database, func(tx *sql.Tx) error {
+		var err error
+		newBalance, err = PointsAdjust(tx, targetID, target, sign*amount, "mod:"+message.User.Name)
+		return err
+	})
+	if err == errInsufficientPoints {
+		return fmt.Sprintf("%s only has %d %s.", target, balance, name)
+	} else if err != nil {
+		handleSQLError(err)
+		return "I couldn't do that due to a SQL error."
+	}
+	return fmt.Sprintf("%s now has %d %s.", target, newBalance, name)
+}
+
+func PointsTopCommand(options string, ch broadcaster) string {
+	limit, err := strconv.Atoi(strings.TrimSpace(options))
+	if err != nil || limit <= 0 {
+		limit = 5
+	}
+	if limit > 10 {
+		limit = 10
+	}
+	entries := PointsTop(limit, ch.database)
+	if len(entries) == 0 {
+		return "Nobody has any " + SettingGet("points.name", ch.database) + " yet."
+	}
+	ranking := make([]string, len(entries))
+	for i, entry := range entries {
+		ranking[i] = fmt.Sprintf("%d. %s (%d)", i+1, entry.userName, entry.balance)
+	}
+	return "Top " + SettingGet("points.name", ch.database) + ": " + strings.Join(ranking, ", ")
+}
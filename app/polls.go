@@ -0,0 +1,305 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+func init() {
+	settingDefaults["poll.tallyseconds"] = "60"
+}
+
+type poll struct {
+	id       int64
+	question string
+	options  []string
+	votes    map[string]int
+	stop     chan struct{}
+}
+
+var (
+	pollMutex sync.Mutex
+	polls     = make(map[string]*poll)
+)
+
+/* Poll Tables */
+
+// PollResults loads a finished or running poll's question and vote counts from the DB.
+func PollResults(id int64, db *sql.DB) (string, []string, []int, error) {
+	var question string
+	if err := db.QueryRow("SELECT question FROM polls WHERE id = $1;", id).Scan(&question); err != nil {
+		return "", nil, nil, err
+	}
+	rows, err := db.Query("SELECT o.label, COUNT(v.userid) FROM polloptions o LEFT JOIN pollvotes v ON v.pollid = o.pollid AND v.choice = o.position WHERE o.pollid = $1 GROUP BY o.position, o.label ORDER BY o.position;", id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		labels []string
+		counts []int
+	)
+	for rows.Next() {
+		var (
+			label string
+			count int
+		)
+		if err := rows.Scan(&label, &count); err != nil {
+			return "", nil, nil, err
+		}
+		labels = append(labels, label)
+		counts = append(counts, count)
+	}
+	return question, labels, counts, rows.Err()
+}
+
+/* Tallies */
+
+func formatTally(question string, labels []string, counts []int) string {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		percent := 0
+		if total > 0 {
+			percent = counts[i] * 100 / total
+		}
+		parts[i] = fmt.Sprintf("%d) %s: %d (%d%%)", i+1, label, counts[i], percent)
+	}
+	return fmt.Sprintf("%s %s", question, strings.Join(parts, " | "))
+}
+
+// tally counts the in-memory votes. Callers hold pollMutex.
+func (p *poll) tally() []int {
+	counts := make([]int, len(p.options))
+	for _, choice := range p.votes {
+		counts[choice-1]++
+	}
+	return counts
+}
+
+// pollFinish stops the poll and records its outcome. Callers hold pollMutex.
+func pollFinish(p *poll, status string, ch broadcaster) string {
+	close(p.stop)
+	delete(polls, ch.name)
+	_, err := ch.database.Exec("UPDATE polls SET status = $1, ended = CURRENT_TIMESTAMP WHERE id = $2;", status, p.id)
+	if err != nil {
+		handleSQLError(err)
+	}
+	if status == "cancelled" {
+		return "The poll was cancelled."
+	}
+
+	counts := p.tally()
+	best, winners := 0, []string{}
+	for i, count := range counts {
+		if count > best {
+			best, winners = count, []string{p.options[i]}
+		} else if count == best && count > 0 {
+			winners = append(winners, p.options[i])
+		}
+	}
+	result := "Poll closed! " + formatTally(p.question, p.options, counts)
+	if len(winners) == 1 {
+		result += " Winner: " + winners[0]
+	} else if len(winners) > 1 {
+		result += " Tie: " + strings.Join(winners, ", ")
+	}
+	return result
+}
+
+/* GoRoutines - Subprocesses */
+
+func pollTallies(p *poll, duration time.Duration, ch broadcaster) {
+	interval := time.Duration(SettingGetInt("poll.tallyseconds", ch.database)) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			pollMutex.Lock()
+			if polls[ch.name] == p {
+				SendChannelMessage(ch.name, "Current votes: "+formatTally(p.question, p.options, p.tally()))
+			}
+			pollMutex.Unlock()
+		case <-deadline:
+			pollMutex.Lock()
+			if polls[ch.name] == p {
+				SendChannelMessage(ch.name, pollFinish(p, "ended", ch))
+			}
+			pollMutex.Unlock()
+			return
+		}
+	}
+}
+
+/* Chat Hooks */
+
+// PollVote records a vote for option n, replacing any earlier vote by the same user-id.
+func PollVote(message twitch.PrivateMessage, choice string, ch broadcaster) string {
+	n, err := strconv.Atoi(strings.TrimSpace(choice))
+	if err != nil {
+		return ""
+	}
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	p := polls[ch.name]
+	if p == nil || n < 1 || n > len(p.options) || message.User.ID == "" {
+		return ""
+	}
+	p.votes[message.User.ID] = n
+
+	_, err = ch.database.Exec("INSERT INTO pollvotes (pollid, userid, username, choice) VALUES ($1, $2, $3, $4) ON CONFLICT (pollid, userid) DO UPDATE SET choice = EXCLUDED.choice, voted = CURRENT_TIMESTAMP;", p.id, message.User.ID, message.User.Name, n)
+	if err != nil {
+		handleSQLError(err)
+	}
+	return ""
+}
+
+// PollObserve counts a bare option number typed in chat as a vote.
+func PollObserve(message twitch.PrivateMessage, ch broadcaster) {
+	text := strings.TrimSpace(message.Message)
+	if _, err := strconv.Atoi(text); err != nil {
+		return
+	}
+	PollVote(message, text, ch)
+}
+
+/* Commands */
+
+// parsePoll splits `"Question" a | b | c [duration]` into its parts. The duration is the last option's last word,
+// and needs a unit, so an option that ends in a number, like "Season 3", stays an option.
+func parsePoll(options string) (string, []string, time.Duration, bool) {
+	options = strings.TrimSpace(options)
+	if !strings.HasPrefix(options, "\"") {
+		return "", nil, 0, false
+	}
+	end := strings.Index(options[1:], "\"")
+	if end < 0 {
+		return "", nil, 0, false
+	}
+	question := strings.TrimSpace(options[1 : end+1])
+	rest := strings.Split(options[end+2:], "|")
+
+	var duration time.Duration
+	last := strings.Fields(rest[len(rest)-1])
+	if len(last) > 1 {
+		if d, err := time.ParseDuration(last[len(last)-1]); err == nil && d > 0 {
+			duration = d
+			rest[len(rest)-1] = strings.Join(last[:len(last)-1], " ")
+		}
+	}
+
+	var choices []string
+	for _, choice := range rest {
+		if choice = strings.TrimSpace(choice); choice != "" {
+			choices = append(choices, choice)
+		}
+	}
+	if question == "" || len(choices) < 2 {
+		return "", nil, 0, false
+	}
+	return question, choices, duration, true
+}
+
+// PollCommand handles !poll "Question" a | b | c [duration], and !poll end|cancel|results [id].
+func PollCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	usage := "Usage: !poll \"Question\" option1 | option2 [duration], or !poll end|cancel|results [id]"
+	fields := strings.Fields(options)
+	if len(fields) == 0 {
+		return usage
+	}
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	p := polls[ch.name]
+
+	switch strings.ToLower(fields[0]) {
+	case "end":
+		if p == nil {
+			return "There's no poll running."
+		}
+		return pollFinish(p, "ended", ch)
+	case "cancel":
+		if p == nil {
+			return "There's no poll running."
+		}
+		return pollFinish(p, "cancelled", ch)
+	case "results":
+		var id int64
+		if len(fields) > 1 {
+			id, _ = strconv.ParseInt(fields[1], 10, 64)
+		} else if err := ch.database.QueryRow("SELECT COALESCE(MAX(id), 0) FROM polls;").Scan(&id); err != nil {
+			handleSQLError(err)
+		}
+		question, labels, counts, err := PollResults(id, ch.database)
+		if err == sql.ErrNoRows {
+			return "I couldn't find that poll."
+		} else if err != nil {
+			handleSQLError(err)
+			return "I couldn't load that poll due to a SQL error."
+		}
+		return fmt.Sprintf("Poll #%d: %s", id, formatTally(question, labels, counts))
+	}
+
+	if p != nil {
+		return "There's already a poll running."
+	}
+	question, choices, duration, ok := parsePoll(options)
+	if !ok {
+		return usage
+	}
+
+	p = &poll{question: question, options: choices, votes: make(map[string]int), stop: make(chan struct{})}
+	err := WithTx(ch.database, func(tx *sql.Tx) error {
+		if err := tx.QueryRow("INSERT INTO polls (question, startedby, status) VALUES ($1, $2, 'open') RETURNING id;", question, message.User.Name).Scan(&p.id); err != nil {
+			return err
+		}
+		for i, choice := range choices {
+			if _, err := tx.Exec("INSERT INTO polloptions (pollid, position, label) VALUES ($1, $2, $3);", p.id, i+1, choice); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't start the poll due to a SQL error."
+	}
+	polls[ch.name] = p
+	go pollTallies(p, duration, ch)
+
+	parts := make([]string, len(choices))
+	for i, choice := range choices {
+		parts[i] = fmt.Sprintf("%d) %s", i+1, choice)
+	}
+	result := fmt.Sprintf("Poll: %s %s. Vote with !vote <number> or just type the number", question, strings.Join(parts, " | "))
+	if duration > 0 {
+		result += fmt.Sprintf(", closing in %v", duration)
+	}
+	return result + "."
+}
@@ -0,0 +1,400 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+var (
+	errNoPrediction     = errors.New("no prediction is running")
+	errPredictionClosed = errors.New("prediction is not taking bets")
+	errOtherSide        = errors.New("already bet on another outcome")
+)
+
+type prediction struct {
+	id       int64
+	question string
+	status   string
+	outcomes []string
+}
+
+type predictionStake struct {
+	userID   string
+	userName string
+	amount   int64
+}
+
+/* Prediction Tables */
+
+// PredictionCurrent loads the channel's open or closed prediction, if any.
+func PredictionCurrent(db *sql.DB) (prediction, error) {
+	var p prediction
+	err := db.QueryRow("SELECT id, question, status FROM predictions WHERE status IN ('open', 'closed') ORDER BY id DESC LIMIT 1;").Scan(&p.id, &p.question, &p.status)
+	if err == sql.ErrNoRows {
+		return p, errNoPrediction
+	} else if err != nil {
+		return p, err
+	}
+
+	rows, err := db.Query("SELECT label FROM predictionoutcomes WHERE predictionid = $1 ORDER BY position;", p.id)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return p, err
+		}
+		p.outcomes = append(p.outcomes, label)
+	}
+	return p, rows.Err()
+}
+
+// outcome finds an outcome by label or 1-based number.
+func (p prediction) outcome(name string) int {
+	for i, label := range p.outcomes {
+		if strings.EqualFold(label, name) {
+			return i + 1
+		}
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(p.outcomes) {
+		return n
+	}
+	return 0
+}
+
+func predictionPools(id int64, outcomes int, db *sql.DB) []int64 {
+	pools := make([]int64, outcomes)
+	rows, err := db.Query("SELECT outcome, SUM(amount) FROM predictionbets WHERE predictionid = $1 GROUP BY outcome;", id)
+	if err != nil {
+		handleSQLError(err)
+		return pools
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			outcome int
+			amount  int64
+		)
+		if err := rows.Scan(&outcome, &amount); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		if outcome >= 1 && outcome <= outcomes {
+			pools[outcome-1] = amount
+		}
+	}
+	return pools
+}
+
+func predictionStakes(tx *sql.Tx, id int64, outcome int) ([]predictionStake, error) {
+	query := "SELECT userid, username, SUM(amount) FROM predictionbets WHERE predictionid = $1 GROUP BY userid, username ORDER BY SUM(amount) DESC, userid;"
+	args := []interface{}{id}
+	if outcome > 0 {
+		query = "SELECT userid, username, SUM(amount) FROM predictionbets WHERE predictionid = $1 AND outcome = $2 GROUP BY userid, username ORDER BY SUM(amount) DESC, userid;"
+		args = append(args, outcome)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stakes []predictionStake
+	for rows.Next() {
+		var stake predictionStake
+		if err := rows.Scan(&stake.userID, &stake.userName, &stake.amount); err != nil {
+			return nil, err
+		}
+		stakes = append(stakes, stake)
+	}
+	return stakes, rows.Err()
+}
+
+func predictionPay(tx *sql.Tx, id int64, stake predictionStake, amount int64, reason string) error {
+	if amount <= 0 {
+		return nil
+	}
+	if _, err := PointsAdjust(tx, stake.userID, stake.userName, amount, fmt.Sprintf("prediction%s:%d", reason, id)); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO predictionpayouts (predictionid, userid, username, amount, reason) VALUES ($1, $2, $3, $4, $5);", id, stake.userID, stake.userName, amount, reason)
+	return err
+}
+
+// predictionShares splits the losing pool across winners in proportion to their stake.
+// Integer leftovers go one point at a time to the largest stakes so no points are lost.
+func predictionShares(winners []predictionStake, losingPool int64) []int64 {
+	var winningPool int64
+	for _, stake := range winners {
+		winningPool += stake.amount
+	}
+	shares := make([]int64, len(winners))
+	if winningPool == 0 {
+		return shares
+	}
+	var distributed int64
+	for i, stake := range winners {
+		share := new(big.Int).Mul(big.NewInt(stake.amount), big.NewInt(losingPool))
+		share.Quo(share, big.NewInt(winningPool))
+		shares[i] = share.Int64()
+		distributed += shares[i]
+	}
+	for i := 0; distributed < losingPool; i = (i + 1) % len(shares) {
+		shares[i]++
+		distributed++
+	}
+	return shares
+}
+
+/* Bets */
+
+// PredictionBet places a wager, debiting the viewer in the same transaction that records it.
+func PredictionBet(message twitch.PrivateMessage, p prediction, outcome int, amount int64, db *sql.DB) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		// Touching the prediction row first serialises bets against close and resolve.
+		res, err := tx.Exec("UPDATE predictions SET pool = pool + $1 WHERE id = $2 AND status = 'open';", amount, p.id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errPredictionClosed
+		}
+
+		var other int
+		err = tx.QueryRow("SELECT COUNT(*) FROM predictionbets WHERE predictionid = $1 AND userid = $2 AND outcome <> $3;", p.id, message.User.ID, outcome).Scan(&other)
+		if err != nil {
+			return err
+		}
+		if other > 0 {
+			return errOtherSide
+		}
+
+		if _, err := PointsAdjust(tx, message.User.ID, message.User.Name, -amount, fmt.Sprintf("predictionbet:%d", p.id)); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO predictionbets (predictionid, userid, username, outcome, amount) VALUES ($1, $2, $3, $4, $5);", p.id, message.User.ID, message.User.Name, outcome, amount)
+		return err
+	})
+}
+
+// PredictionResolve pays out the winning side and closes the prediction in one transaction.
+func PredictionResolve(p prediction, outcome int, db *sql.DB) (int, error) {
+	var paid int
+	err := WithTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE predictions SET status = 'resolved', winner = $1, finished = CURRENT_TIMESTAMP WHERE id = $2 AND status IN ('open', 'closed');", outcome, p.id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errNoPrediction
+		}
+
+		everyone, err := predictionStakes(tx, p.id, 0)
+		if err != nil {
+			return err
+		}
+		winners, err := predictionStakes(tx, p.id, outcome)
+		if err != nil {
+			return err
+		}
+		if len(winners) == 0 {
+			// Nobody picked the right answer, so nobody loses anything either.
+			for _, stake := range everyone {
+				if err := predictionPay(tx, p.id, stake, stake.amount, "refund"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var total, winningPool int64
+		for _, stake := range everyone {
+			total += stake.amount
+		}
+		for _, stake := range winners {
+			winningPool += stake.amount
+		}
+		shares := predictionShares(winners, total-winningPool)
+		for i, stake := range winners {
+			if err := predictionPay(tx, p.id, stake, stake.amount+shares[i], "win"); err != nil {
+				return err
+			}
+		}
+		paid = len(winners)
+		return nil
+	})
+	return paid, err
+}
+
+// PredictionCancel refunds every wager and marks the prediction cancelled.
+func PredictionCancel(p prediction, db *sql.DB) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE predictions SET status = 'cancelled', finished = CURRENT_TIMESTAMP WHERE id = $1 AND status IN ('open', 'closed');", p.id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errNoPrediction
+		}
+		stakes, err := predictionStakes(tx, p.id, 0)
+		if err != nil {
+			return err
+		}
+		for _, stake := range stakes {
+			if err := predictionPay(tx, p.id, stake, stake.amount, "refund"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Commands */
+
+func parsePrediction(options string) (string, []string, bool) {
+	options = strings.TrimSpace(options)
+	if !strings.HasPrefix(options, "\"") {
+		return "", nil, false
+	}
+	end := strings.Index(options[1:], "\"")
+	if end < 0 {
+		return "", nil, false
+	}
+	question := strings.TrimSpace(options[1 : end+1])
+	var outcomes []string
+	for _, outcome := range strings.Split(options[end+2:], "|") {
+		if outcome = strings.TrimSpace(outcome); outcome != "" {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	return question, outcomes, question != "" && len(outcomes) >= 2
+}
+
+func predictionSummary(p prediction, db *sql.DB) string {
+	pools := predictionPools(p.id, len(p.outcomes), db)
+	parts := make([]string, len(p.outcomes))
+	for i, label := range p.outcomes {
+		parts[i] = fmt.Sprintf("%s: %d", label, pools[i])
+	}
+	return fmt.Sprintf("%s (%s) %s", p.question, p.status, strings.Join(parts, " | "))
+}
+
+// BetCommand handles !bet <outcome> <amount> for viewers and open/close/resolve/cancel for mods.
+func BetCommand(message twitch.PrivateMessage, options string, userPermissionLevel string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	name := SettingGet("points.name", ch.database)
+	isMod := AuthorizeCommand(userPermissionLevel, message.User.Name, "m")
+
+	if len(fields) > 0 && isMod {
+		switch strings.ToLower(fields[0]) {
+		case "open":
+			if _, err := PredictionCurrent(ch.database); err != errNoPrediction {
+				return "There's already a prediction running."
+			}
+			question, outcomes, ok := parsePrediction(strings.TrimSpace(options)[len(fields[0]):])
+			if !ok {
+				return "Usage: !bet open \"Question\" outcome1|outcome2"
+			}
+			err := WithTx(ch.database, func(tx *sql.Tx) error {
+				var id int64
+				if err := tx.QueryRow("INSERT INTO predictions (question, status, openedby) VALUES ($1, 'open', $2) RETURNING id;", question, message.User.Name).Scan(&id); err != nil {
+					return err
+				}
+				for i, outcome := range outcomes {
+					if _, err := tx.Exec("INSERT INTO predictionoutcomes (predictionid, position, label) VALUES ($1, $2, $3);", id, i+1, outcome); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				handleSQLError(err)
+				return "I couldn't open the prediction due to a SQL error."
+			}
+			return fmt.Sprintf("Prediction open: %s Bet with !bet <%s> <amount>.", question, strings.Join(outcomes, "|"))
+		case "close":
+			p, err := PredictionCurrent(ch.database)
+			if err != nil || p.status != "open" {
+				return "There's no open prediction."
+			}
+			if _, err := ch.database.Exec("UPDATE predictions SET status = 'closed' WHERE id = $1 AND status = 'open';", p.id); err != nil {
+				handleSQLError(err)
+				return "I couldn't close the prediction due to a SQL error."
+			}
+			p.status = "closed"
+			return "Bets are closed! " + predictionSummary(p, ch.database)
+		case "resolve":
+			p, err := PredictionCurrent(ch.database)
+			if err != nil {
+				return "There's no prediction to resolve."
+			}
+			if len(fields) < 2 || p.outcome(strings.Join(fields[1:], " ")) == 0 {
+				return "Usage: !bet resolve <" + strings.Join(p.outcomes, "|") + ">"
+			}
+			outcome := p.outcome(strings.Join(fields[1:], " "))
+			winners, err := PredictionResolve(p, outcome, ch.database)
+			if err == errNoPrediction {
+				return "There's no prediction to resolve."
+			} else if err != nil {
+				handleSQLError(err)
+				return "I couldn't resolve the prediction due to a SQL error."
+			}
+			if winners == 0 {
+				return fmt.Sprintf("%s won, but nobody picked it. Everyone's %s were refunded.", p.outcomes[outcome-1], name)
+			}
+			return fmt.Sprintf("%s won! %d viewers were paid out.", p.outcomes[outcome-1], winners)
+		case "cancel":
+			p, err := PredictionCurrent(ch.database)
+			if err != nil {
+				return "There's no prediction to cancel."
+			}
+			if err := PredictionCancel(p, ch.database); err != nil && err != errNoPrediction {
+				handleSQLError(err)
+				return "I couldn't cancel the prediction due to a SQL error."
+			}
+			return fmt.Sprintf("The prediction was cancelled and all %s were refunded.", name)
+		}
+	}
+
+	p, err := PredictionCurrent(ch.database)
+	if err == errNoPrediction {
+		return ""
+	} else if err != nil {
+		handleSQLError(err)
+		return ""
+	}
+	if len(fields) < 2 {
+		return predictionSummary(p, ch.database)
+	}
+
+	outcome := p.outcome(strings.Join(fields[:len(fields)-1], " "))
+	amount, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if outcome == 0 || err != nil || amount <= 0 {
+		return "Usage: !bet <" + strings.Join(p.outcomes, "|") + "> <amount>"
+	}
+	err = PredictionBet(message, p, outcome, amount, ch.database)
+	switch err {
+	case nil:
+		return ""
+	case errInsufficientPoints:
+		return fmt.Sprintf("Sorry {user}, you don't have %d %s.", amount, name)
+	case errPredictionClosed:
+		return "Sorry {user}, bets are closed."
+	case errOtherSide:
+		return "Sorry {user}, you've already bet on a different outcome."
+	default:
+		handleSQLError(err)
+		return "I couldn't place that bet due to a SQL error."
+	}
+}
@@ -0,0 +1,250 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+var (
+	errQueueClosed = errors.New("queue is closed")
+	errQueueFull   = errors.New("queue is full")
+	errQueued      = errors.New("already in the queue")
+)
+
+func init() {
+	settingDefaults["queue.open"] = "false"
+	settingDefaults["queue.maxsize"] = "50"
+	settingDefaults["queue.subpriority"] = "true"
+}
+
+type queueEntry struct {
+	userID   string
+	userName string
+}
+
+/* Queue Table */
+
+// QueueJoin adds a viewer to the end of their priority band.
+func QueueJoin(userID, userName string, priority int, db *sql.DB) error {
+	if !SettingGetBool("queue.open", db) {
+		return errQueueClosed
+	}
+	maxSize := SettingGetInt("queue.maxsize", db)
+	return WithTx(db, func(tx *sql.Tx) error {
+		// Joins take turns, so two at once can't both see room for one more. Reads carry on meanwhile.
+		if _, err := tx.Exec("LOCK TABLE queue IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+			return err
+		}
+		var (
+			size   int
+			queued int
+		)
+		err := tx.QueryRow("SELECT COUNT(*), COUNT(CASE WHEN userid = $1 THEN 1 END) FROM queue;", userID).Scan(&size, &queued)
+		if err != nil {
+			return err
+		}
+		if queued > 0 {
+			return errQueued
+		}
+		if maxSize > 0 && size >= maxSize {
+			return errQueueFull
+		}
+		_, err = tx.Exec("INSERT INTO queue (userid, username, priority) VALUES ($1, $2, $3);", userID, userName, priority)
+		return err
+	})
+}
+
+func QueueLeave(userID string, db *sql.DB) bool {
+	res, err := db.Exec("DELETE FROM queue WHERE userid = $1;", userID)
+	if err != nil {
+		handleSQLError(err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// QueuePosition returns the viewer's 1-based place in line, or 0 if they aren't queued.
+func QueuePosition(userID string, db *sql.DB) int {
+	var (
+		id       int64
+		priority int
+		position int
+	)
+	err := db.QueryRow("SELECT id, priority FROM queue WHERE userid = $1;", userID).Scan(&id, &priority)
+	if err == sql.ErrNoRows {
+		return 0
+	} else if err != nil {
+		handleSQLError(err)
+		return 0
+	}
+	err = db.QueryRow("SELECT COUNT(*) + 1 FROM queue WHERE priority > $1 OR (priority = $1 AND id < $2);", priority, id).Scan(&position)
+	if err != nil {
+		handleSQLError(err)
+		return 0
+	}
+	return position
+}
+
+func QueueList(limit int, db *sql.DB) []queueEntry {
+	rows, err := db.Query("SELECT userid, username FROM queue ORDER BY priority DESC, id LIMIT $1;", limit)
+	if err != nil {
+		handleSQLError(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []queueEntry
+	for rows.Next() {
+		var entry queueEntry
+		if err := rows.Scan(&entry.userID, &entry.userName); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// QueueNext removes and returns the first n viewers in line.
+func QueueNext(n int, db *sql.DB) ([]queueEntry, error) {
+	var entries []queueEntry
+	err := WithTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id, userid, username FROM queue ORDER BY priority DESC, id LIMIT $1;", n)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var (
+				id    int64
+				entry queueEntry
+			)
+			if err := rows.Scan(&id, &entry.userID, &entry.userName); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		for _, id := range ids {
+			if _, err := tx.Exec("DELETE FROM queue WHERE id = $1;", id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+/* Commands */
+
+func queueNames(entries []queueEntry) string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = fmt.Sprintf("%d. %s", i+1, entry.userName)
+	}
+	return strings.Join(names, ", ")
+}
+
+// QueueCommand handles !queue join|leave|position|list for viewers and next|open|close|clear for mods.
+func QueueCommand(message twitch.PrivateMessage, options string, userPermissionLevel string, ch broadcaster) string {
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		fields = []string{"position"}
+	}
+	isMod := AuthorizeCommand(userPermissionLevel, message.User.Name, "m")
+
+	switch fields[0] {
+	case "join":
+		priority := 0
+		subscribed := message.User.Badges["subscriber"] > 0 || message.User.Badges["founder"] > 0
+		if subscribed && SettingGetBool("queue.subpriority", ch.database) {
+			priority = 1
+		}
+		err := QueueJoin(message.User.ID, message.User.Name, priority, ch.database)
+		switch err {
+		case nil:
+			return fmt.Sprintf("{user} joined the queue at position %d.", QueuePosition(message.User.ID, ch.database))
+		case errQueueClosed:
+			return "Sorry {user}, the queue is closed."
+		case errQueueFull:
+			return "Sorry {user}, the queue is full."
+		case errQueued:
+			return fmt.Sprintf("{user}, you're already in the queue at position %d.", QueuePosition(message.User.ID, ch.database))
+		default:
+			handleSQLError(err)
+			return "I couldn't add you to the queue due to a SQL error."
+		}
+	case "leave":
+		if QueueLeave(message.User.ID, ch.database) {
+			return "{user} left the queue."
+		}
+		return "{user}, you weren't in the queue."
+	case "position":
+		if position := QueuePosition(message.User.ID, ch.database); position > 0 {
+			return fmt.Sprintf("{user}, you're number %d in the queue.", position)
+		}
+		return "{user}, you're not in the queue."
+	case "list":
+		entries := QueueList(10, ch.database)
+		if len(entries) == 0 {
+			return "The queue is empty."
+		}
+		return "Queue: " + queueNames(entries)
+	}
+
+	if !isMod {
+		return ""
+	}
+	switch fields[0] {
+	case "next":
+		// Capped like the list, so everyone taken off the queue fits in the one message telling them.
+		n := 1
+		if len(fields) > 1 {
+			if parsed, err := strconv.Atoi(fields[1]); err == nil && parsed > 0 {
+				n = parsed
+			}
+		}
+		if n > 10 {
+			n = 10
+		}
+		entries, err := QueueNext(n, ch.database)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't advance the queue due to a SQL error."
+		}
+		if len(entries) == 0 {
+			return "The queue is empty."
+		}
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = "@" + entry.userName
+		}
+		return "You're up: " + strings.Join(names, ", ")
+	case "open", "close":
+		if err := SettingSet("queue.open", strconv.FormatBool(fields[0] == "open"), ch.database); err != nil {
+			handleSQLError(err)
+			return "I couldn't change the queue due to a SQL error."
+		}
+		if fields[0] == "open" {
+			return "The queue is open! Type !queue join to get in line."
+		}
+		return "The queue is closed."
+	case "clear":
+		if _, err := ch.database.Exec("DELETE FROM queue;"); err != nil {
+			handleSQLError(err)
+			return "I couldn't clear the queue due to a SQL error."
+		}
+		return "The queue has been cleared."
+	default:
+		return "Usage: !queue join|leave|position|list, or !queue next [n]|open|close|clear"
+	}
+}
@@ -0,0 +1,411 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["raid.enabled"] = "true"
+	settingDefaults["raid.window"] = "30"
+	settingDefaults["raid.messages"] = "60"
+	settingDefaults["raid.newratio"] = "60"
+	settingDefaults["raid.joins"] = "40"
+	// Hype and copy-pasta are duplicates too, so it takes a lot of long copies to count as a wave, and by
+	// default their posters are only reported to mods rather than timed out.
+	settingDefaults["raid.duplicates"] = "15"
+	settingDefaults["raid.duplicatelength"] = "25"
+	settingDefaults["raid.lockdown"] = "followers:10,slow:30"
+	settingDefaults["raid.timeout"] = "0"
+	settingDefaults["raid.quietseconds"] = "120"
+	settingDefaults["raid.incomingseconds"] = "300"
+	settingValidators["raid.lockdown"] = validLockdown
+}
+
+// lockdownModes are the chat modes a lockdown can turn on, with the commands to turn them on and off,
+// the unit of the mode's optional value, and the ROOMSTATE tag that says whether the mode's on.
+var lockdownModes = map[string][4]string{
+	"followers":   {"/followers", "/followersoff", "m", "followers-only"},
+	"slow":        {"/slow", "/slowoff", "", "slow"},
+	"emoteonly":   {"/emoteonly", "/emoteonlyoff", "", "emote-only"},
+	"subscribers": {"/subscribers", "/subscribersoff", "", "subs-only"},
+}
+
+type raidMessage struct {
+	at       time.Time
+	userName string
+	isNew    bool
+	exempt   bool
+	words    map[string]bool
+}
+
+// raidWatch is a channel's sliding window of chat and JOIN activity, plus any lockdown in force.
+type raidWatch struct {
+	messages []raidMessage
+	joins    []time.Time
+	// room is the chat modes as ROOMSTATE last reported them, so a lockdown knows what it's changing.
+	room map[string]int
+	// lockdown holds the commands that put the chat modes back as they were, and is nil when there's no lockdown.
+	lockdown []string
+	lastWave time.Time
+	// incoming is when a Twitch raid last arrived. Its viewers join and chat all at once, so for a while
+	// after, JOINs and a chat full of new faces are expected rather than a sign of trouble.
+	incoming time.Time
+	// generation counts lockdowns, so a revert left over from an earlier one can tell it's stale.
+	generation int
+	// wave holds the words of the duplicated message that set off the lockdown, so later copies are caught too.
+	wave map[string]bool
+	// flagged is everyone who posted the wave's message during the lockdown.
+	flagged map[string]bool
+}
+
+var (
+	raidMutex   sync.Mutex
+	raidWatches = make(map[string]*raidWatch)
+)
+
+/* Detection */
+
+func raidWatchFor(channel string) *raidWatch {
+	w, ok := raidWatches[channel]
+	if !ok {
+		w = &raidWatch{}
+		raidWatches[channel] = w
+	}
+	return w
+}
+
+// prune drops activity older than the window.
+func (w *raidWatch) prune(window time.Duration) {
+	cutoff := time.Now().Add(-window)
+	i := 0
+	for i < len(w.messages) && w.messages[i].at.Before(cutoff) {
+		i++
+	}
+	w.messages = w.messages[i:]
+	i = 0
+	for i < len(w.joins) && w.joins[i].Before(cutoff) {
+		i++
+	}
+	w.joins = w.joins[i:]
+}
+
+// raidWords reduces a message to its set of words with digits dropped, so "join now 123" and "join now 456" match.
+func raidWords(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, token := range BlocklistTokens(text, false) {
+		token = strings.TrimFunc(token, unicode.IsDigit)
+		if token != "" {
+			words[token] = true
+		}
+	}
+	return words
+}
+
+// similar is the Jaccard similarity of two word sets, as a percentage.
+func similar(a, b map[string]bool) int {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	return shared * 100 / (len(a) + len(b) - shared)
+}
+
+// waveReason checks the window against the channel's thresholds and says what looks like a raid, if anything.
+// When the wave is near-duplicate messages, it also returns the words of the duplicated message.
+func (w *raidWatch) waveReason(latest raidMessage, ch broadcaster) (string, map[string]bool) {
+	friendly := time.Since(w.incoming) < time.Duration(SettingGetInt("raid.incomingseconds", ch.database))*time.Second
+	if limit := SettingGetInt("raid.joins", ch.database); limit > 0 && !friendly && len(w.joins) >= limit {
+		return fmt.Sprintf("%d joins", len(w.joins)), nil
+	}
+	if limit := SettingGetInt("raid.duplicates", ch.database); limit > 0 && latest.words != nil {
+		copies := 0
+		for _, m := range w.messages {
+			if m.words != nil && similar(m.words, latest.words) >= 80 {
+				copies++
+			}
+		}
+		if copies >= limit {
+			return fmt.Sprintf("%d copies of one message", copies), latest.words
+		}
+	}
+	if limit := SettingGetInt("raid.messages", ch.database); limit > 0 && !friendly && len(w.messages) >= limit {
+		newCount := 0
+		for _, m := range w.messages {
+			if m.isNew {
+				newCount++
+			}
+		}
+		if newCount*100/len(w.messages) >= SettingGetInt("raid.newratio", ch.database) {
+			return fmt.Sprintf("%d messages, %d from new chatters", len(w.messages), newCount), nil
+		}
+	}
+	return "", nil
+}
+
+// RaidObserve adds the message to the channel's window and starts or extends a lockdown when it sees a wave.
+// It reports whether the message was timed out as part of the wave.
+func RaidObserve(message twitch.PrivateMessage, ch broadcaster) bool {
+	if ch.database == nil || !SettingGetBool("raid.enabled", ch.database) {
+		return false
+	}
+	window := time.Duration(SettingGetInt("raid.window", ch.database)) * time.Second
+	m := raidMessage{at: time.Now(), userName: message.User.Name, isNew: IsNewChatter(message, ch), exempt: UserRank(message, ch) >= roleRanks["vip"]}
+	if len([]rune(message.Message)) >= SettingGetInt("raid.duplicatelength", ch.database) {
+		m.words = raidWords(message.Message)
+	}
+
+	raidMutex.Lock()
+	w := raidWatchFor(ch.name)
+	w.prune(window)
+	w.messages = append(w.messages, m)
+	reason, cluster := w.waveReason(m, ch)
+	if reason != "" {
+		w.lastWave = time.Now()
+		if cluster != nil {
+			w.wave = cluster
+		}
+	}
+	starting := reason != "" && w.lockdown == nil
+	generation := w.generation
+	var commands []string
+	if starting {
+		generation, commands = w.start(ch)
+	}
+
+	// During a lockdown, everyone who posted the wave's message is flagged, and timed out if the channel wants.
+	var targets []string
+	if w.lockdown != nil && w.wave != nil {
+		for _, recent := range w.messages {
+			if recent.words != nil && !recent.exempt && !w.flagged[recent.userName] && similar(recent.words, w.wave) >= 80 {
+				w.flagged[recent.userName] = true
+				targets = append(targets, recent.userName)
+			}
+		}
+	}
+	raidMutex.Unlock()
+
+	if starting {
+		zap.S().Infof("Raid detected in %v: %v", ch.name, reason)
+		sendLockdown(commands, ch)
+		SendChannelMessage(ch.name, "Raid protection is on, chat will go back to normal shortly.")
+		WhisperMods(ch, fmt.Sprintf("Raid protection turned on in %s (%s). Use !lockdown off to end it early.", ch.name, reason))
+		go raidRevert(ch, generation)
+	}
+
+	removed := false
+	if seconds := SettingGetInt("raid.timeout", ch.database); seconds > 0 {
+		for _, target := range targets {
+			ApplyModAction(modAction{kind: "timeout", seconds: seconds}, twitch.PrivateMessage{User: twitch.User{Name: target}}, "raid", ch)
+			removed = removed || target == message.User.Name
+		}
+	}
+	return removed
+}
+
+// RaidJoin counts a JOIN from the membership capability towards the channel's join velocity.
+func RaidJoin(message twitch.UserJoinMessage, ch broadcaster) {
+	if ch.database == nil || !SettingGetBool("raid.enabled", ch.database) {
+		return
+	}
+	window := time.Duration(SettingGetInt("raid.window", ch.database)) * time.Second
+	raidMutex.Lock()
+	w := raidWatchFor(ch.name)
+	w.prune(window)
+	w.joins = append(w.joins, time.Now())
+	raidMutex.Unlock()
+}
+
+// RaidIncoming notes a Twitch raid arriving, so its viewers joining and saying hello don't set off a lockdown.
+// Copies of one message are still caught, since a hate raid can arrive as a Twitch raid too.
+func RaidIncoming(message twitch.UserNoticeMessage, ch broadcaster) {
+	if message.MsgID != "raid" || ch.database == nil {
+		return
+	}
+	zap.S().Infof("%v raided %v with %v viewers", message.MsgParams["msg-param-displayName"], ch.name, message.MsgParams["msg-param-viewerCount"])
+	raidMutex.Lock()
+	w := raidWatchFor(ch.name)
+	w.incoming = time.Now()
+	w.joins = nil
+	raidMutex.Unlock()
+}
+
+// RaidRoomState keeps track of the channel's chat modes. ROOMSTATE lists them all on join, and after that
+// only the ones that changed.
+func RaidRoomState(message twitch.RoomStateMessage, ch broadcaster) {
+	if ch.database == nil {
+		return
+	}
+	raidMutex.Lock()
+	w := raidWatchFor(ch.name)
+	if w.room == nil {
+		w.room = make(map[string]int)
+	}
+	for tag, value := range message.State {
+		w.room[tag] = value
+	}
+	raidMutex.Unlock()
+}
+
+/* Lockdown */
+
+// start begins a lockdown, returning its generation and the commands that turn it on. Modes the channel
+// already has on as the lockdown wants them are left alone, and the rest are put back as they were when it ends.
+// Callers hold raidMutex.
+func (w *raidWatch) start(ch broadcaster) (int, []string) {
+	var on []string
+	w.lockdown = []string{}
+	for _, mode := range strings.Split(SettingGet("raid.lockdown", ch.database), ",") {
+		parts := strings.SplitN(strings.TrimSpace(mode), ":", 2)
+		commands, ok := lockdownModes[parts[0]]
+		if !ok {
+			continue
+		}
+		command := commands[0]
+		if len(parts) == 2 {
+			command += " " + parts[1] + commands[2]
+		}
+		// Followers-only is -1 when it's off, since 0 means any follower can chat. The others are 0 when off.
+		value, known := w.room[commands[3]]
+		if !known || value < 0 || (value == 0 && commands[3] != "followers-only") {
+			on = append(on, command)
+			w.lockdown = append(w.lockdown, commands[1])
+			continue
+		}
+		previous := commands[0]
+		if commands[3] == "followers-only" || commands[3] == "slow" {
+			previous += " " + strconv.Itoa(value) + commands[2]
+		}
+		if previous != command {
+			on = append(on, command)
+			w.lockdown = append(w.lockdown, previous)
+		}
+	}
+	w.flagged = make(map[string]bool)
+	w.generation++
+	return w.generation, on
+}
+
+// stop ends the lockdown, returning the commands that put the chat modes back, and who was flagged.
+// Callers hold raidMutex.
+func (w *raidWatch) stop() ([]string, []string) {
+	restore := w.lockdown
+	var flagged []string
+	for name := range w.flagged {
+		flagged = append(flagged, name)
+	}
+	w.lockdown, w.wave, w.flagged = nil, nil, nil
+	w.generation++
+	return restore, flagged
+}
+
+func validLockdown(value string) string {
+	for _, mode := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(mode), ":", 2)
+		if _, ok := lockdownModes[parts[0]]; !ok {
+			return "Lockdown modes are followers[:minutes], slow[:seconds], emoteonly and subscribers, separated by commas."
+		}
+		if len(parts) == 2 {
+			if n, err := strconv.Atoi(parts[1]); err != nil || n < 0 {
+				return fmt.Sprintf("%s needs a whole number.", parts[0])
+			}
+		}
+	}
+	return ""
+}
+
+// sendLockdown sends the commands that turn a lockdown on, or put the chat modes back.
+func sendLockdown(commands []string, ch broadcaster) {
+	for _, command := range commands {
+		if err := SendChannelMessage(ch.name, command); err != nil {
+			zap.S().Errorf("Couldn't send %v in %v: %v", command, ch.name, err)
+		}
+	}
+}
+
+// lockdownReport tells the mods who posted the wave's message, when they weren't timed out for it.
+func lockdownReport(flagged []string, ch broadcaster) {
+	if len(flagged) == 0 || SettingGetInt("raid.timeout", ch.database) > 0 {
+		return
+	}
+	sort.Strings(flagged)
+	WhisperMods(ch, truncateMessage(fmt.Sprintf("The raid lockdown in %s is over. %d chatters posted the wave's message: %s",
+		ch.name, len(flagged), strings.Join(flagged, ", "))))
+}
+
+// raidRevert lifts the lockdown once chat has been quiet for raid.quietseconds. It gives up once the lockdown
+// it was started for is over, so it can't lift a later one early.
+func raidRevert(ch broadcaster, generation int) {
+	for {
+		time.Sleep(10 * time.Second)
+		quiet := time.Duration(SettingGetInt("raid.quietseconds", ch.database)) * time.Second
+		raidMutex.Lock()
+		w := raidWatchFor(ch.name)
+		if w.lockdown == nil || w.generation != generation {
+			raidMutex.Unlock()
+			return
+		}
+		if time.Since(w.lastWave) < quiet {
+			raidMutex.Unlock()
+			continue
+		}
+		restore, flagged := w.stop()
+		raidMutex.Unlock()
+
+		zap.S().Infof("Lifting the raid lockdown in %v", ch.name)
+		sendLockdown(restore, ch)
+		SendChannelMessage(ch.name, "Raid protection is off, thanks for your patience.")
+		lockdownReport(flagged, ch)
+		return
+	}
+}
+
+// LockdownCommand handles !lockdown on|off, for mods to start or end a lockdown by hand.
+func LockdownCommand(options string, ch broadcaster) string {
+	raidMutex.Lock()
+	w := raidWatchFor(ch.name)
+	active := w.lockdown != nil
+	switch strings.ToLower(strings.TrimSpace(options)) {
+	case "on":
+		if active {
+			raidMutex.Unlock()
+			return "Raid protection is already on."
+		}
+		generation, commands := w.start(ch)
+		w.lastWave = time.Now()
+		raidMutex.Unlock()
+		sendLockdown(commands, ch)
+		go raidRevert(ch, generation)
+		return "Raid protection is on."
+	case "off":
+		if !active {
+			raidMutex.Unlock()
+			return "Raid protection isn't on."
+		}
+		restore, flagged := w.stop()
+		raidMutex.Unlock()
+		sendLockdown(restore, ch)
+		lockdownReport(flagged, ch)
+		return "Raid protection is off."
+	default:
+		raidMutex.Unlock()
+		if active {
+			return "Raid protection is on. Usage: !lockdown on|off"
+		}
+		return "Raid protection is off. Usage: !lockdown on|off"
+	}
+}
@@ -0,0 +1,329 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+
+	"go.uber.org/zap"
+)
+
+// The repositories hold every query against the original bot and channel tables.
+// User input only ever reaches the database as a statement parameter, never as SQL text.
+
+// channelNamePattern is what a Twitch login can contain, and so what can name a channel database.
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,25}$`)
+
+var errBadChannelName = errors.New("channel names are 1 to 25 letters, digits or underscores")
+
+// ValidChannelName reports whether the name is safe to use as a channel database name.
+func ValidChannelName(name string) bool {
+	return channelNamePattern.MatchString(name)
+}
+
+// quote is a single row of a channel's quotes table.
+type quote struct {
+	id      int
+	text    string
+	addedBy string
+}
+
+// channelUser is a single row of a channel's channelusers table.
+type channelUser struct {
+	name           string
+	lastSeen       string
+	streamsVisited int
+	watchTime      int
+	streamer       bool
+	streamLink     string
+}
+
+// The columns every repository selects, in the order the scan helpers read them.
+const (
+	commandColumns = "trigger, COALESCE(payload, ''), COALESCE(permission, ''), COALESCE(cooldown, 0), COALESCE(cost, 0)"
+	userColumns    = "name, COALESCE(lastseen, ''), COALESCE(streamsvisited, 0), COALESCE(watchtime, 0), COALESCE(streamer, false), COALESCE(streamlink, '')"
+	quoteColumns   = "id, COALESCE(quote, ''), COALESCE(addedby, '')"
+)
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCommand(row scanner) (command, error) {
+	var comm command
+	err := row.Scan(&comm.trigger, &comm.payload, &comm.permission, &comm.cooldown, &comm.cost)
+	return comm, err
+}
+
+func scanUser(row scanner) (channelUser, error) {
+	var u channelUser
+	err := row.Scan(&u.name, &u.lastSeen, &u.streamsVisited, &u.watchTime, &u.streamer, &u.streamLink)
+	return u, err
+}
+
+func scanQuote(row scanner) (quote, error) {
+	var q quote
+	err := row.Scan(&q.id, &q.text, &q.addedBy)
+	return q, err
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryAll runs a query and scans every row with scan.
+func queryAll[T any](db querier, scan func(scanner) (T, error), query string, args ...interface{}) ([]T, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []T
+	for rows.Next() {
+		value, err := scan(rows)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// queryStrings runs a query selecting one text column and collects it.
+func queryStrings(db querier, query string, args ...interface{}) ([]string, error) {
+	return queryAll(db, func(row scanner) (string, error) {
+		var value string
+		err := row.Scan(&value)
+		return value, err
+	}, query, args...)
+}
+
+// affected reports whether a statement changed any rows.
+func affected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+/* Bot Repository */
+
+// BotRepository reads and writes the bot DB's broadcasters table.
+type BotRepository struct {
+	db *sql.DB
+}
+
+// Broadcasters lists the channels that have a database ready.
+func (r BotRepository) Broadcasters() ([]string, error) {
+	return queryStrings(r.db, "SELECT channelname FROM broadcasters WHERE dbcreated = true ORDER BY channelname;")
+}
+
+// BroadcasterAdd requests a channel, leaving it unauthorized. Requesting twice is harmless.
+func (r BotRepository) BroadcasterAdd(name string) error {
+	if !ValidChannelName(name) {
+		return errBadChannelName
+	}
+	_, err := r.db.Exec("INSERT INTO broadcasters (channelname, dbcreated, authorized) VALUES ($1, false, false) ON CONFLICT (channelname) DO NOTHING;", name)
+	return err
+}
+
+// Broadcaster reports whether the channel's database exists and whether it's authorized.
+func (r BotRepository) Broadcaster(name string) (dbCreated, authorized bool, err error) {
+	err = r.db.QueryRow("SELECT COALESCE(dbcreated, false), COALESCE(authorized, false) FROM broadcasters WHERE channelname = $1;", name).Scan(&dbCreated, &authorized)
+	return dbCreated, authorized, err
+}
+
+// BroadcasterID is the channel's row id, which the shared tables key its rows by.
+func (r BotRepository) BroadcasterID(name string) (int, error) {
+	var id int
+	err := r.db.QueryRow("SELECT id FROM broadcasters WHERE channelname = $1;", name).Scan(&id)
+	return id, err
+}
+
+func (r BotRepository) BroadcasterAuthorize(name string) error {
+	_, err := r.db.Exec("UPDATE broadcasters SET authorized = true WHERE channelname = $1;", name)
+	return err
+}
+
+func (r BotRepository) BroadcasterCreated(name string) error {
+	_, err := r.db.Exec("UPDATE broadcasters SET dbcreated = true WHERE channelname = $1;", name)
+	return err
+}
+
+func (r BotRepository) BroadcasterRemove(name string) error {
+	_, err := r.db.Exec("DELETE FROM broadcasters WHERE channelname = $1;", name)
+	return err
+}
+
+/* Channel Repository */
+
+// ChannelRepository reads and writes the commands, channelusers and quotes tables of a channel's own Postgres database.
+type ChannelRepository struct {
+	db *sql.DB
+}
+
+func (r ChannelRepository) DB() *sql.DB {
+	return r.db
+}
+
+func (r ChannelRepository) MigrationSets() []string {
+	return []string{"postgres/channel", "postgres/features"}
+}
+
+func (r ChannelRepository) Prepare() {
+	for _, set := range r.MigrationSets() {
+		if err := MigrateOnConnect(r.db, set, "a channel DB"); err != nil {
+			zap.S().Errorf("Couldn't migrate a channel DB: %v", err)
+			return
+		}
+	}
+}
+
+func (r ChannelRepository) CommandTriggers() ([]string, error) {
+	return queryStrings(r.db, "SELECT DISTINCT trigger FROM commands;")
+}
+
+func (r ChannelRepository) Commands() ([]command, error) {
+	return queryAll(r.db, scanCommand, "SELECT "+commandColumns+" FROM commands ORDER BY trigger;")
+}
+
+// Command looks a command up by trigger, returning sql.ErrNoRows when there isn't one.
+func (r ChannelRepository) Command(trigger string) (command, error) {
+	return scanCommand(r.db.QueryRow("SELECT "+commandColumns+" FROM commands WHERE trigger = $1;", trigger))
+}
+
+func (r ChannelRepository) CommandInsert(comm command) error {
+	_, err := r.db.Exec("INSERT INTO commands (trigger, payload, permission, cooldown, cost) VALUES ($1, $2, $3, $4, $5);", comm.trigger, comm.payload, comm.permission, comm.cooldown, comm.cost)
+	return err
+}
+
+// CommandUpdate overwrites the command's fields, reporting whether it existed.
+func (r ChannelRepository) CommandUpdate(comm command) (bool, error) {
+	return affected(r.db.Exec("UPDATE commands SET payload = $1, permission = $2, cooldown = $3, cost = $4 WHERE trigger = $5;", comm.payload, comm.permission, comm.cooldown, comm.cost, comm.trigger))
+}
+
+// CommandRemove deletes the command, reporting whether it existed.
+func (r ChannelRepository) CommandRemove(trigger string) (bool, error) {
+	return affected(r.db.Exec("DELETE FROM commands WHERE trigger = $1;", trigger))
+}
+
+// User looks a chatter up by login name, returning sql.ErrNoRows when they've never been seen.
+func (r ChannelRepository) User(name string) (channelUser, error) {
+	return scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM channelusers WHERE name = $1;", name))
+}
+
+func (r ChannelRepository) Users() ([]channelUser, error) {
+	return queryAll(r.db, scanUser, "SELECT "+userColumns+" FROM channelusers ORDER BY name;")
+}
+
+// UserAdd stores a chatter the channel hasn't seen before, leaving one it has alone.
+func (r ChannelRepository) UserAdd(u channelUser) error {
+	_, err := r.db.Exec("INSERT INTO channelusers (name, lastseen, streamsvisited, watchtime, streamer, streamlink) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (name) DO NOTHING;", u.name, u.lastSeen, u.streamsVisited, u.watchTime, u.streamer, u.streamLink)
+	return err
+}
+
+// Quote looks a quote up by number, returning sql.ErrNoRows when there isn't one.
+func (r ChannelRepository) Quote(id int) (quote, error) {
+	return scanQuote(r.db.QueryRow("SELECT "+quoteColumns+" FROM quotes WHERE id = $1;", id))
+}
+
+func (r ChannelRepository) Quotes() ([]quote, error) {
+	return queryAll(r.db, scanQuote, "SELECT "+quoteColumns+" FROM quotes ORDER BY id;")
+}
+
+// QuoteAdd stores a quote and returns its number.
+func (r ChannelRepository) QuoteAdd(text, addedBy string) (int, error) {
+	var id int
+	err := r.db.QueryRow("INSERT INTO quotes (quote, addedby) VALUES ($1, $2) RETURNING id;", text, addedBy).Scan(&id)
+	return id, err
+}
+
+// QuoteImport stores a quote under the number it already has, leaving any quote with that number alone.
+func (r ChannelRepository) QuoteImport(q quote) error {
+	return WithTx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO quotes (id, quote, addedby) OVERRIDING SYSTEM VALUE VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING;", q.id, q.text, q.addedBy); err != nil {
+			return err
+		}
+		// Numbering carries on after the highest quote, not from wherever the sequence was.
+		_, err := tx.Exec("SELECT setval(pg_get_serial_sequence('quotes', 'id'), GREATEST((SELECT MAX(id) FROM quotes), 1));")
+		return err
+	})
+}
+
+/* Tenant Repository */
+
+// TenantRepository is one channel's rows in commands, channelusers and quotes tables that every channel shares.
+// Every statement is scoped by channel_id, so a channel can only ever see or change its own rows.
+// Its SQL runs on both Postgres and SQLite.
+type TenantRepository struct {
+	db        *sql.DB
+	channelID int
+}
+
+func (r TenantRepository) CommandTriggers() ([]string, error) {
+	return queryStrings(r.db, "SELECT trigger FROM commands WHERE channel_id = $1;", r.channelID)
+}
+
+func (r TenantRepository) Commands() ([]command, error) {
+	return queryAll(r.db, scanCommand, "SELECT "+commandColumns+" FROM commands WHERE channel_id = $1 ORDER BY trigger;", r.channelID)
+}
+
+func (r TenantRepository) Command(trigger string) (command, error) {
+	return scanCommand(r.db.QueryRow("SELECT "+commandColumns+" FROM commands WHERE channel_id = $1 AND trigger = $2;", r.channelID, trigger))
+}
+
+func (r TenantRepository) CommandInsert(comm command) error {
+	_, err := r.db.Exec("INSERT INTO commands (channel_id, trigger, payload, permission, cooldown, cost) VALUES ($1, $2, $3, $4, $5, $6);", r.channelID, comm.trigger, comm.payload, comm.permission, comm.cooldown, comm.cost)
+	return err
+}
+
+func (r TenantRepository) CommandUpdate(comm command) (bool, error) {
+	return affected(r.db.Exec("UPDATE commands SET payload = $1, permission = $2, cooldown = $3, cost = $4 WHERE channel_id = $5 AND trigger = $6;", comm.payload, comm.permission, comm.cooldown, comm.cost, r.channelID, comm.trigger))
+}
+
+func (r TenantRepository) CommandRemove(trigger string) (bool, error) {
+	return affected(r.db.Exec("DELETE FROM commands WHERE channel_id = $1 AND trigger = $2;", r.channelID, trigger))
+}
+
+func (r TenantRepository) User(name string) (channelUser, error) {
+	return scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM channelusers WHERE channel_id = $1 AND name = $2;", r.channelID, name))
+}
+
+func (r TenantRepository) Users() ([]channelUser, error) {
+	return queryAll(r.db, scanUser, "SELECT "+userColumns+" FROM channelusers WHERE channel_id = $1 ORDER BY name;", r.channelID)
+}
+
+func (r TenantRepository) UserAdd(u channelUser) error {
+	_, err := r.db.Exec("INSERT INTO channelusers (channel_id, name, lastseen, streamsvisited, watchtime, streamer, streamlink) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (channel_id, name) DO NOTHING;", r.channelID, u.name, u.lastSeen, u.streamsVisited, u.watchTime, u.streamer, u.streamLink)
+	return err
+}
+
+func (r TenantRepository) Quote(id int) (quote, error) {
+	return scanQuote(r.db.QueryRow("SELECT "+quoteColumns+" FROM quotes WHERE channel_id = $1 AND id = $2;", r.channelID, id))
+}
+
+func (r TenantRepository) Quotes() ([]quote, error) {
+	return queryAll(r.db, scanQuote, "SELECT "+quoteColumns+" FROM quotes WHERE channel_id = $1 ORDER BY id;", r.channelID)
+}
+
+// QuoteAdd numbers quotes per channel, so each channel's start at 1 as they do in a database of their own.
+// Two quotes added at the same moment can pick the same number; the primary key turns the second away.
+func (r TenantRepository) QuoteAdd(text, addedBy string) (int, error) {
+	var id int
+	err := WithTx(r.db, func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM quotes WHERE channel_id = $1;", r.channelID).Scan(&id); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO quotes (channel_id, id, quote, addedby) VALUES ($1, $2, $3, $4);", r.channelID, id, text, addedBy)
+		return err
+	})
+	return id, err
+}
+
+func (r TenantRepository) QuoteImport(q quote) error {
+	_, err := r.db.Exec("INSERT INTO quotes (channel_id, id, quote, addedby) VALUES ($1, $2, $3, $4) ON CONFLICT (channel_id, id) DO NOTHING;", r.channelID, q.id, q.text, q.addedBy)
+	return err
+}
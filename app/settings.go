@@ -0,0 +1,177 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// settingDefaults holds every per-channel setting the bot understands, along with its default value.
+// Features register their keys here so !setting can validate them.
+var settingDefaults = map[string]string{}
+
+var (
+	settingsMutex sync.Mutex
+	settingsCache = make(map[*sql.DB]map[string]string)
+)
+
+// settingValidators optionally check a value before !setting saves it, returning a reason when it's rejected.
+var settingValidators = map[string]func(value string) string{}
+
+/* Settings Table */
+
+// SettingGet reads a setting through the in-memory cache, since filters check settings on every message.
+// Without a feature DB there's nowhere to keep settings, so the defaults apply.
+func SettingGet(name string, db *sql.DB) string {
+	if db == nil {
+		return settingDefaults[name]
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	values, ok := settingsCache[db]
+	if !ok {
+		values = loadSettings(db)
+		settingsCache[db] = values
+	}
+	if value, ok := values[name]; ok {
+		return value
+	}
+	return settingDefaults[name]
+}
+
+func loadSettings(db *sql.DB) map[string]string {
+	values := make(map[string]string)
+	rows, err := db.Query("SELECT name, value FROM settings;")
+	if err != nil {
+		handleSQLError(err)
+		return values
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		values[name] = value
+	}
+	return values
+}
+
+func SettingGetInt(name string, db *sql.DB) int {
+	value, err := strconv.Atoi(SettingGet(name, db))
+	if err != nil {
+		zap.S().Errorf("Setting %v is not an integer: %v", name, err)
+		value, _ = strconv.Atoi(settingDefaults[name])
+	}
+	return value
+}
+
+func SettingGetFloat(name string, db *sql.DB) float64 {
+	value, err := strconv.ParseFloat(SettingGet(name, db), 64)
+	if err != nil {
+		zap.S().Errorf("Setting %v is not a number: %v", name, err)
+		value, _ = strconv.ParseFloat(settingDefaults[name], 64)
+	}
+	return value
+}
+
+func SettingGetBool(name string, db *sql.DB) bool {
+	value, err := strconv.ParseBool(SettingGet(name, db))
+	if err != nil {
+		zap.S().Errorf("Setting %v is not a boolean: %v", name, err)
+		value, _ = strconv.ParseBool(settingDefaults[name])
+	}
+	return value
+}
+
+func SettingSet(name, value string, db *sql.DB) error {
+	zap.S().Infof("Setting %v to %v", name, value)
+	_, err := db.Exec("INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value;", name, value)
+	if err != nil {
+		return err
+	}
+	settingsMutex.Lock()
+	if values, ok := settingsCache[db]; ok {
+		values[name] = value
+	}
+	settingsMutex.Unlock()
+	CacheNotify(channelForDB(db), "settings")
+	return nil
+}
+
+// settingsInvalidate drops a channel's cached settings, to be read again on next use.
+func settingsInvalidate(db *sql.DB) {
+	settingsMutex.Lock()
+	delete(settingsCache, db)
+	settingsMutex.Unlock()
+}
+
+/* Commands */
+
+// SettingCommand handles !setting <name> [value]. With no value it reports the current one.
+func SettingCommand(options string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	prefix := ""
+	if len(fields) > 0 {
+		prefix = strings.ToLower(fields[0])
+	}
+	def, ok := settingDefaults[prefix]
+	if !ok {
+		// Not an exact name, so list everything under it. There are too many settings to list in one message.
+		groups := make(map[string]bool)
+		var names []string
+		for name := range settingDefaults {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			group, start := name, len(prefix)
+			if start < len(name) && name[start] == '.' {
+				start++
+			}
+			if i := strings.Index(name[start:], "."); i >= 0 {
+				group = name[:start+i]
+			}
+			if !groups[group] {
+				groups[group] = true
+				names = append(names, group)
+			}
+		}
+		if len(names) == 0 {
+			return fmt.Sprintf("I don't know a setting called %s.", prefix)
+		}
+		sort.Strings(names)
+		return "Settings: " + strings.Join(names, ", ")
+	}
+	name := prefix
+	if len(fields) == 1 {
+		return fmt.Sprintf("%s is %s", name, SettingGet(name, ch.database))
+	}
+
+	value := strings.Join(fields[1:], " ")
+	if _, err := strconv.ParseFloat(def, 64); err == nil {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Sprintf("%s needs a number.", name)
+		}
+	} else if _, err := strconv.ParseBool(def); err == nil {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Sprintf("%s needs true or false.", name)
+		}
+	}
+	if validate, ok := settingValidators[name]; ok {
+		if problem := validate(value); problem != "" {
+			return problem
+		}
+	}
+	if err := SettingSet(name, value, ch.database); err != nil {
+		handleSQLError(err)
+		return "I couldn't save that setting due to a SQL error."
+	}
+	return fmt.Sprintf("%s set to %s", name, value)
+}
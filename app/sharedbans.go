@@ -0,0 +1,302 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["sharedbans.mode"] = "off"
+	settingDefaults["sharedbans.tags"] = ""
+	settingValidators["sharedbans.mode"] = func(value string) string {
+		switch strings.ToLower(value) {
+		case "off", "apply", "review":
+			return ""
+		}
+		return "Shared bans are off, apply (ban automatically) or review (ask the mods first)."
+	}
+}
+
+// banTag finds the #tag in a ban reason that marks it for sharing.
+var banTag = regexp.MustCompile(`#([a-z0-9_]+)`)
+
+/* Shared Bans Tables */
+
+func sharedBanAudit(banID int64, channel, action, actor string) {
+	_, err := BOTDB.Exec("INSERT INTO sharedbanaudit (banid, channel, action, actor) VALUES ($1, $2, $3, $4);", banID, channel, action, actor)
+	if err != nil {
+		handleSQLError(err)
+	}
+}
+
+// sharedBanSubscribed reports how the channel takes bans with this tag: off, apply or review.
+func sharedBanSubscribed(tag string, ch broadcaster) string {
+	mode := strings.ToLower(SettingGet("sharedbans.mode", ch.database))
+	if mode == "off" {
+		return mode
+	}
+	tags := strings.TrimSpace(SettingGet("sharedbans.tags", ch.database))
+	if tags == "" {
+		return mode
+	}
+	for _, want := range strings.Split(tags, ",") {
+		if strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(want), "#"), tag) {
+			return mode
+		}
+	}
+	return "off"
+}
+
+/* Propagation */
+
+// SharedBanPublish adds a ban to the shared list and applies it, or flags it, in every opted-in channel.
+func SharedBanPublish(userName, tag, reason, moderator string, origin broadcaster) (int64, error) {
+	userName, tag = strings.ToLower(userName), strings.ToLower(tag)
+	var id int64
+	err := BOTDB.QueryRow("INSERT INTO sharedbans (username, tag, reason, channel, moderator) VALUES ($1, $2, $3, $4, $5) RETURNING id;", userName, tag, reason, origin.name, moderator).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	sharedBanAudit(id, origin.name, "published", moderator)
+	zap.S().Infof("Shared ban #%d of %v (#%v) from %v", id, userName, tag, origin.name)
+
+	for name, ch := range channels {
+		if name == origin.name || ch.database == nil {
+			continue
+		}
+		switch sharedBanSubscribed(tag, ch) {
+		case "apply":
+			ApplyModAction(modAction{kind: "ban"}, twitch.PrivateMessage{User: twitch.User{Name: userName}}, fmt.Sprintf("shared ban #%s from %s: %s", tag, origin.name, reason), ch)
+			sharedBanAudit(id, name, "applied", "bot")
+		case "review":
+			WhisperMods(ch, fmt.Sprintf("%s was banned in %s for #%s (%s). Use !sharedban approve %d or !sharedban dismiss %d in %s.", userName, origin.name, tag, reason, id, id, name))
+			sharedBanAudit(id, name, "flagged", "bot")
+		}
+	}
+	return id, nil
+}
+
+// SharedBanObserve publishes a mod's ban whose reason carries a #tag. It's fed from EventSub, since IRC doesn't
+// carry ban reasons anymore. The bot's own bans echo back here and are skipped: !sharedban has already published
+// its ban, and the bans it applies for other channels' would be published all over again.
+func SharedBanObserve(userName, reason, moderator string, ch broadcaster) {
+	if ch.database == nil || strings.EqualFold(moderator, username) {
+		return
+	}
+	if strings.ToLower(SettingGet("sharedbans.mode", ch.database)) == "off" {
+		return
+	}
+	match := banTag.FindStringSubmatch(strings.ToLower(reason))
+	if match == nil {
+		return
+	}
+	var existing int
+	err := BOTDB.QueryRow("SELECT COUNT(*) FROM sharedbans WHERE username = $1 AND channel = $2 AND active;", strings.ToLower(userName), ch.name).Scan(&existing)
+	if err != nil || existing > 0 {
+		return
+	}
+	if _, err := SharedBanPublish(userName, match[1], reason, moderator, ch); err != nil {
+		handleSQLError(err)
+	}
+}
+
+// SharedBanUnbanObserve follows a mod's unban. In the channel a shared ban came from, it lifts the ban everywhere,
+// as !sharedban lift does. Anywhere else it only overrides the ban in that channel, which the audit trail records.
+func SharedBanUnbanObserve(userName, moderator string, ch broadcaster) {
+	if ch.database == nil || strings.EqualFold(moderator, username) {
+		return
+	}
+	userName = strings.ToLower(userName)
+	lifted, err := sharedBanLift(userName, moderator, ch)
+	if err != nil {
+		handleSQLError(err)
+		return
+	}
+	if lifted > 0 {
+		zap.S().Infof("%v unbanned %v in %v, lifting their shared ban", moderator, userName, ch.name)
+		return
+	}
+	ids, err := queryAll(BOTDB, func(row scanner) (int64, error) {
+		var id int64
+		err := row.Scan(&id)
+		return id, err
+	}, "SELECT DISTINCT b.id FROM sharedbans b JOIN sharedbanaudit a ON a.banid = b.id WHERE b.username = $1 AND b.active AND a.channel = $2 AND a.action IN ('applied', 'approved');", userName, ch.name)
+	if err != nil {
+		handleSQLError(err)
+		return
+	}
+	for _, id := range ids {
+		sharedBanAudit(id, ch.name, "unbanned", moderator)
+	}
+}
+
+// sharedBanLift marks the user's active shared bans lifted and unbans them wherever the bot applied them.
+func sharedBanLift(userName, moderator string, origin broadcaster) (int, error) {
+	rows, err := BOTDB.Query("UPDATE sharedbans SET active = false WHERE username = $1 AND channel = $2 AND active RETURNING id;", strings.ToLower(userName), origin.name)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		sharedBanAudit(id, origin.name, "lifted", moderator)
+		applied, err := BOTDB.Query("SELECT DISTINCT channel FROM sharedbanaudit WHERE banid = $1 AND action IN ('applied', 'approved');", id)
+		if err != nil {
+			handleSQLError(err)
+			continue
+		}
+		var names []string
+		for applied.Next() {
+			var name string
+			if err := applied.Scan(&name); err == nil {
+				names = append(names, name)
+			}
+		}
+		applied.Close()
+		for _, name := range names {
+			if ch, ok := channels[name]; ok {
+				if err := SendChannelMessage(ch.name, "/unban "+userName); err != nil {
+					zap.S().Errorf("Couldn't unban %v in %v: %v", userName, ch.name, err)
+					continue
+				}
+				sharedBanAudit(id, name, "unbanned", "bot")
+			}
+		}
+	}
+	return len(ids), nil
+}
+
+/* Commands */
+
+// SharedBanCommand handles !sharedban <user> #tag [reason], lift <user>, approve|dismiss <id> and audit <user>.
+func SharedBanCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	usage := "Usage: !sharedban <user> #tag [reason], !sharedban lift <user>, !sharedban approve|dismiss <id>, !sharedban audit <user>"
+	fields := strings.Fields(options)
+	if len(fields) < 2 {
+		return usage
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "lift":
+		target := strings.ToLower(strings.TrimPrefix(fields[1], "@"))
+		lifted, err := sharedBanLift(target, message.User.Name, ch)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't lift that ban due to a SQL error."
+		}
+		if lifted == 0 {
+			return fmt.Sprintf("%s has no shared ban from this channel.", target)
+		}
+		SendChannelMessage(ch.name, "/unban "+target)
+		return fmt.Sprintf("Lifted the shared ban on %s everywhere it was applied.", target)
+	case "approve", "dismiss":
+		id, err := strconv.ParseInt(strings.TrimPrefix(fields[1], "#"), 10, 64)
+		if err != nil {
+			return usage
+		}
+		var (
+			target, tag, origin, reason string
+			active                      bool
+		)
+		err = BOTDB.QueryRow("SELECT username, tag, channel, reason, active FROM sharedbans WHERE id = $1;", id).Scan(&target, &tag, &origin, &reason, &active)
+		if err == sql.ErrNoRows {
+			return fmt.Sprintf("There's no shared ban #%d.", id)
+		} else if err != nil {
+			handleSQLError(err)
+			return "I couldn't look up that ban due to a SQL error."
+		}
+		if strings.ToLower(fields[0]) == "dismiss" {
+			sharedBanAudit(id, ch.name, "dismissed", message.User.Name)
+			return fmt.Sprintf("Dismissed the shared ban on %s.", target)
+		}
+		if !active {
+			return fmt.Sprintf("The shared ban on %s was already lifted.", target)
+		}
+		ApplyModAction(modAction{kind: "ban"}, twitch.PrivateMessage{User: twitch.User{Name: target}}, fmt.Sprintf("shared ban #%s from %s: %s", tag, origin, reason), ch)
+		sharedBanAudit(id, ch.name, "approved", message.User.Name)
+		return fmt.Sprintf("Banned %s from the shared list.", target)
+	case "audit":
+		return sharedBanHistory(strings.ToLower(strings.TrimPrefix(fields[1], "@")))
+	}
+
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	match := banTag.FindStringSubmatch(strings.ToLower(fields[1]))
+	if match == nil {
+		return usage
+	}
+	reason := strings.Join(fields[2:], " ")
+	ApplyModAction(modAction{kind: "ban"}, twitch.PrivateMessage{User: twitch.User{Name: target}}, "#"+match[1]+" "+reason, ch)
+	id, err := SharedBanPublish(target, match[1], reason, message.User.Name, ch)
+	if err != nil {
+		handleSQLError(err)
+		return "I banned them here, but couldn't share the ban due to a SQL error."
+	}
+	return fmt.Sprintf("Banned %s and shared it as #%d (#%s).", target, id, match[1])
+}
+
+// sharedBanHistory summarises where each of the user's shared bans came from and what every channel did with it.
+func sharedBanHistory(target string) string {
+	rows, err := BOTDB.Query("SELECT b.id, b.tag, b.channel, b.moderator, b.active, a.channel, a.action FROM sharedbans b LEFT JOIN sharedbanaudit a ON a.banid = b.id AND a.action NOT IN ('published') WHERE b.username = $1 ORDER BY b.id DESC, a.id;", target)
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't read the audit trail due to a SQL error."
+	}
+	defer rows.Close()
+
+	var (
+		parts   []string
+		current int64
+		events  []string
+		header  string
+	)
+	flush := func() {
+		if header != "" {
+			parts = append(parts, header+" "+strings.Join(events, ", "))
+		}
+	}
+	for rows.Next() {
+		var (
+			id                        int64
+			tag, origin, moderator    string
+			active                    bool
+			auditChannel, auditAction sql.NullString
+		)
+		if err := rows.Scan(&id, &tag, &origin, &moderator, &active, &auditChannel, &auditAction); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		if id != current {
+			flush()
+			current, events = id, nil
+			header = fmt.Sprintf("#%d #%s from %s by %s", id, tag, origin, moderator)
+			if !active {
+				header += " (lifted)"
+			}
+			header += ":"
+		}
+		if auditChannel.Valid {
+			events = append(events, auditAction.String+" in "+auditChannel.String)
+		}
+	}
+	flush()
+	if len(parts) == 0 {
+		return fmt.Sprintf("%s isn't on the shared ban list.", target)
+	}
+	result := target + ": " + strings.Join(parts, "; ")
+	result = truncateMessage(result)
+	return result
+}
@@ -0,0 +1,165 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+// spamFilterDefaults are the tunables for each spam filter, on top of enabled, action and exempt.
+var spamFilterDefaults = map[string]map[string]string{
+	"caps":       {"threshold": "70", "minlength": "15", "action": "delete", "exempt": "sub"},
+	"symbols":    {"threshold": "50", "minlength": "15", "action": "delete", "exempt": "sub"},
+	"repetition": {"chars": "15", "words": "8", "action": "delete", "exempt": "sub"},
+	"emotes":     {"max": "15", "action": "delete", "exempt": "sub"},
+	"length":     {"max": "400", "action": "delete", "exempt": "vip"},
+	"zalgo":      {"max": "6", "action": "timeout:60", "exempt": "vip"},
+}
+
+func init() {
+	for filter, defaults := range spamFilterDefaults {
+		settingDefaults["filter."+filter+".enabled"] = "true"
+		for key, value := range defaults {
+			settingDefaults["filter."+filter+"."+key] = value
+		}
+		settingValidators["filter."+filter+".action"] = validModAction
+		settingValidators["filter."+filter+".exempt"] = validRole
+	}
+	messageFilters = append(messageFilters,
+		spamFilter("caps", capsFilter),
+		spamFilter("symbols", symbolsFilter),
+		spamFilter("repetition", repetitionFilter),
+		spamFilter("emotes", emotesFilter),
+		spamFilter("length", lengthFilter),
+		spamFilter("zalgo", zalgoFilter),
+	)
+}
+
+// spamFilter wraps a check with the filter's enabled switch, exemption and action.
+// The check gets a setting reader for its own tunables and returns a reason when the message breaks the rule.
+func spamFilter(name string, check func(message twitch.PrivateMessage, setting func(key string) int) string) messageFilter {
+	return func(message twitch.PrivateMessage, ch broadcaster) *filterHit {
+		if !SettingGetBool("filter."+name+".enabled", ch.database) || filterExempt(name, message, ch) {
+			return nil
+		}
+		setting := func(key string) int {
+			return FilterThreshold(name, key, message, ch)
+		}
+		reason := check(message, setting)
+		if reason == "" {
+			return nil
+		}
+		return &filterHit{filter: name, reason: reason, action: filterAction(name, ch)}
+	}
+}
+
+// FilterThreshold reads one of a filter's numeric tunables for this message.
+// Lower is always stricter, so new chatters get the value scaled down.
+func FilterThreshold(filter, key string, message twitch.PrivateMessage, ch broadcaster) int {
+	return newChatterThreshold(SettingGetInt("filter."+filter+"."+key, ch.database), message, ch)
+}
+
+/* Filters */
+
+func capsFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	letters, upper := 0, 0
+	for _, r := range message.Message {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters < setting("minlength") || letters == 0 {
+		return ""
+	}
+	if upper*100/letters >= setting("threshold") {
+		return "too many capital letters"
+	}
+	return ""
+}
+
+func symbolsFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	total, symbols := 0, 0
+	for _, r := range message.Message {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		total++
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r) {
+			symbols++
+		}
+	}
+	if total < setting("minlength") || total == 0 {
+		return ""
+	}
+	if symbols*100/total >= setting("threshold") {
+		return "too many symbols"
+	}
+	return ""
+}
+
+func repetitionFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	maxChars := setting("chars")
+	run, last := 0, rune(0)
+	for _, r := range message.Message {
+		if r == last {
+			run++
+		} else {
+			run, last = 1, r
+		}
+		if maxChars > 0 && run >= maxChars && !unicode.IsSpace(r) {
+			return "repeated characters"
+		}
+	}
+
+	maxWords := setting("words")
+	counts := make(map[string]int)
+	for _, word := range strings.Fields(strings.ToLower(message.Message)) {
+		counts[word]++
+		if maxWords > 0 && counts[word] >= maxWords {
+			return "repeated words"
+		}
+	}
+	return ""
+}
+
+// emotesFilter counts emotes from the message's emotes tag, as parsed by the IRC client.
+func emotesFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	count := 0
+	for _, emote := range message.Emotes {
+		count += emote.Count
+	}
+	if limit := setting("max"); limit > 0 && count > limit {
+		return fmt.Sprintf("too many emotes (%d)", count)
+	}
+	return ""
+}
+
+func lengthFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	if limit := setting("max"); limit > 0 && len([]rune(message.Message)) > limit {
+		return "message too long"
+	}
+	return ""
+}
+
+// zalgoFilter looks for stacked combining marks, the usual way zalgo text smears over chat.
+func zalgoFilter(message twitch.PrivateMessage, setting func(string) int) string {
+	limit := setting("max")
+	stacked := 0
+	for _, r := range message.Message {
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) {
+			stacked++
+			if limit > 0 && stacked > limit {
+				return "zalgo text"
+			}
+		} else {
+			stacked = 0
+		}
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// STORE is where the broadcasters and every channel's commands, users and quotes live.
+var STORE Store
+
+// Store holds the bot's broadcasters and opens each channel's storage.
+type Store interface {
+	Broadcasters() ([]string, error)
+	BroadcasterAdd(name string) error
+	Broadcaster(name string) (dbCreated, authorized bool, err error)
+	BroadcasterAuthorize(name string) error
+	BroadcasterCreated(name string) error
+	BroadcasterRemove(name string) error
+
+	// ChannelCreate sets up storage for a newly authorized channel.
+	ChannelCreate(name string) error
+	Channel(name string) (ChannelStore, error)
+	// DB is the bot database, for the tables that span channels.
+	DB() *sql.DB
+	// MigrationSet names the migrations that build the bot database.
+	MigrationSet() string
+}
+
+// ChannelStore holds one channel's commands, users and quotes.
+type ChannelStore interface {
+	// DB is the database the channel is stored in. featureDB says whether its feature tables are there too.
+	DB() *sql.DB
+	// MigrationSets names the migrations that build the channel's database, in order, or is empty when
+	// the channel lives in the bot database and is migrated with it.
+	MigrationSets() []string
+	// Prepare brings the channel's tables up to date as the bot connects.
+	Prepare()
+
+	CommandTriggers() ([]string, error)
+	Commands() ([]command, error)
+	Command(trigger string) (command, error)
+	CommandInsert(comm command) error
+	CommandUpdate(comm command) (bool, error)
+	CommandRemove(trigger string) (bool, error)
+
+	User(name string) (channelUser, error)
+	Users() ([]channelUser, error)
+	UserAdd(u channelUser) error
+
+	Quote(id int) (quote, error)
+	Quotes() ([]quote, error)
+	QuoteAdd(text, addedBy string) (int, error)
+	// QuoteImport stores a quote under its existing number, for copying a channel between stores.
+	QuoteImport(q quote) error
+}
+
+// StoreOpen connects to the store DB_TYPE names: postgres (the default), whose credentials come from
+// the db-* secrets, or sqlite3, which keeps the whole deployment in the file DB_FILE.
+// On Postgres, DB_TENANCY=shared keeps every channel in the bot DB instead of a database each.
+func StoreOpen() (Store, error) {
+	switch dbType := os.Getenv("DB_TYPE"); dbType {
+	case "", "postgres":
+		if os.Getenv("DB_TENANCY") == "shared" {
+			return sharedStoreOpen()
+		}
+		return postgresStoreOpen()
+	case "sqlite3", "sqlite":
+		file := os.Getenv("DB_FILE")
+		if file == "" {
+			file = "bot.db"
+		}
+		return sqliteStoreOpen(file)
+	default:
+		return nil, fmt.Errorf("unknown DB_TYPE %q, expected postgres or sqlite3", dbType)
+	}
+}
+
+/* Postgres */
+
+// postgresStore keeps the broadcasters in the bot DB and gives every channel a database of its own.
+type postgresStore struct {
+	BotRepository
+	endpoint, user, password, name string
+}
+
+func postgresStoreOpen() (postgresStore, error) {
+	awsRegion := os.Getenv("AWS_REGION")
+	s := postgresStore{
+		endpoint: getSecret("db-endpoint", awsRegion),
+		user:     getSecret("db-user", awsRegion),
+		password: getSecret("db-password", awsRegion),
+		name:     getSecret("db-name", awsRegion),
+	}
+	db, err := DBConnect(s.endpoint, s.user, s.password, s.name, "postgres")
+	if err != nil {
+		return s, err
+	}
+	s.BotRepository = BotRepository{db}
+	return s, nil
+}
+
+func (s postgresStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s postgresStore) MigrationSet() string {
+	return "postgres/bot"
+}
+
+func (s postgresStore) ChannelCreate(name string) error {
+	// Database names can't be statement parameters, so the name is validated and quoted instead.
+	if !ValidChannelName(name) {
+		return errBadChannelName
+	}
+	if _, err := s.db.Exec("CREATE DATABASE " + pq.QuoteIdentifier(name) + ";"); err != nil {
+		handleSQLError(err)
+	}
+
+	zap.S().Info("Creating new DB conenction")
+	database, err := DBConnect(s.endpoint, s.user, s.password, name, "postgres")
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	// A new database is migrated even when migrations are manual, since there's nothing in it to protect.
+	for _, set := range (ChannelRepository{database}).MigrationSets() {
+		if _, err := Migrate(database, set, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s postgresStore) Channel(name string) (ChannelStore, error) {
+	if !ValidChannelName(name) {
+		return nil, errBadChannelName
+	}
+	database, err := DBConnect(s.endpoint, s.user, s.password, name, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	return ChannelRepository{database}, nil
+}
+
+/* SQLite */
+
+// sqliteStore keeps a whole deployment in one file, for running locally and in tests.
+// The broadcasters queries are the same as Postgres', so it reuses BotRepository for them.
+type sqliteStore struct {
+	BotRepository
+}
+
+func sqliteStoreOpen(file string) (Store, error) {
+	zap.S().Infof("Opening the SQLite store %v", file)
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, and an in-memory database is private to its connection.
+	db.SetMaxOpenConns(1)
+	return sqliteStore{BotRepository{db}}, nil
+}
+
+func (s sqliteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s sqliteStore) MigrationSet() string {
+	return "sqlite"
+}
+
+// ChannelCreate has nothing to do, since the channel tables are shared and migrated with the store.
+func (s sqliteStore) ChannelCreate(name string) error {
+	if !ValidChannelName(name) {
+		return errBadChannelName
+	}
+	return nil
+}
+
+func (s sqliteStore) Channel(name string) (ChannelStore, error) {
+	if !ValidChannelName(name) {
+		return nil, errBadChannelName
+	}
+	id, err := s.BroadcasterID(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a broadcaster: %v", name, err)
+	}
+	return sqliteChannel{TenantRepository{s.db, id}, name}, nil
+}
+
+// sqliteChannel is one channel's share of the SQLite store.
+type sqliteChannel struct {
+	TenantRepository
+	channel string
+}
+
+func (c sqliteChannel) DB() *sql.DB {
+	return c.db
+}
+
+func (c sqliteChannel) MigrationSets() []string {
+	return nil
+}
+
+// featureDB is where the channel's feature tables live, or nil on a SQLite store, which doesn't keep them.
+// Every SQLite channel shares one database, so handing it out would mix their settings and points.
+func featureDB(st ChannelStore) *sql.DB {
+	if _, sqlite := st.(sqliteChannel); sqlite {
+		return nil
+	}
+	return st.DB()
+}
+
+// botDBPostgres reports whether the bot DB is Postgres, so it has the shared feature tables like the default
+// trivia bank, and can carry notifications between instances.
+func botDBPostgres() bool {
+	_, sqlite := STORE.(sqliteStore)
+	return STORE != nil && !sqlite
+}
+
+// Prepare skips the feature tables: they're written for Postgres, and on SQLite they'd be shared
+// between channels. Only commands, users and quotes work against a SQLite store.
+func (c sqliteChannel) Prepare() {
+	zap.S().Warnf("%v is on a SQLite store, so only commands, users and quotes are stored", c.channel)
+}
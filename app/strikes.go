@@ -0,0 +1,152 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	settingDefaults["strikes.enabled"] = "true"
+	settingDefaults["strikes.decaydays"] = "30"
+	settingDefaults["strikes.ladder"] = "warn,timeout:60,timeout:600,timeout:86400,ban"
+	settingValidators["strikes.ladder"] = validStrikeLadder
+}
+
+/* Strikes Table */
+
+// strikesFor matches a user's strikes by user-id, so a rename keeps them. Strikes issued to a name the bot
+// couldn't find an id for are matched by name instead.
+const strikesFor = "(userid = $1 OR ($1 = '' AND username = $2)) AND created > CURRENT_TIMESTAMP - ($3 * INTERVAL '1 day')"
+
+// StrikeAdd records a strike and returns how many strikes the user has that haven't decayed yet.
+func StrikeAdd(userID, userName, reason, issuedBy string, ch broadcaster) (int, error) {
+	var count int
+	userName = strings.ToLower(userName)
+	// Read before the transaction, since loading the settings would need a second connection from the pool.
+	decayDays := SettingGetInt("strikes.decaydays", ch.database)
+	err := WithTx(ch.database, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO strikes (userid, username, reason, issuedby) VALUES ($1, $2, $3, $4);", userID, userName, reason, issuedBy)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow("SELECT COUNT(*) FROM strikes WHERE "+strikesFor+";", userID, userName, decayDays).Scan(&count)
+	})
+	return count, err
+}
+
+// strikeUserID finds the user-id behind a name a mod typed, from the points table or else from Twitch.
+// It's "" when neither knows the name.
+func strikeUserID(userName string, ch broadcaster) string {
+	if userID, _, err := PointsLookup(userName, ch.database); err == nil && userID != "" {
+		return userID
+	}
+	userID, err := HelixUserID(userName)
+	if err != nil && err != errHelixDisabled {
+		zap.S().Errorf("Couldn't look up %v's user-id: %v", userName, err)
+	}
+	return userID
+}
+
+// StrikeAction is the ladder step for the user's nth active strike. Strikes past the end stay on the last step.
+func StrikeAction(count int, ch broadcaster) modAction {
+	value := SettingGet("strikes.ladder", ch.database)
+	if validStrikeLadder(value) != "" {
+		zap.S().Errorf("Bad strike ladder in %v, using the default", ch.name)
+		value = settingDefaults["strikes.ladder"]
+	}
+	ladder := strings.Split(value, ",")
+	if count > len(ladder) {
+		count = len(ladder)
+	}
+	if count < 1 {
+		count = 1
+	}
+	action, _ := parseModAction(ladder[count-1])
+	return action
+}
+
+func validStrikeLadder(value string) string {
+	for _, step := range strings.Split(value, ",") {
+		if _, ok := parseModAction(step); !ok {
+			return "The ladder is a comma-separated list of warn, delete, timeout:<seconds> or ban."
+		}
+	}
+	return ""
+}
+
+// strikeEscalate adds a strike for a filter hit and returns the harsher of the filter's action and the ladder's.
+func strikeEscalate(hit *filterHit, message twitch.PrivateMessage, ch broadcaster) modAction {
+	if !SettingGetBool("strikes.enabled", ch.database) {
+		return hit.action
+	}
+	count, err := StrikeAdd(message.User.ID, message.User.Name, hit.filter+": "+hit.reason, "filter", ch)
+	if err != nil {
+		handleSQLError(err)
+		return hit.action
+	}
+	if step := StrikeAction(count, ch); step.severity() > hit.action.severity() {
+		return step
+	}
+	return hit.action
+}
+
+/* Commands */
+
+// StrikeCommand handles !strike <user> <reason>, issuing the next step of the ladder.
+func StrikeCommand(message twitch.PrivateMessage, options string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	if len(fields) < 2 {
+		return "Usage: !strike <user> <reason>"
+	}
+	target := strings.ToLower(strings.TrimPrefix(fields[0], "@"))
+	reason := strings.Join(fields[1:], " ")
+	targetID := strikeUserID(target, ch)
+
+	count, err := StrikeAdd(targetID, target, reason, message.User.Name, ch)
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't record that strike due to a SQL error."
+	}
+	action := StrikeAction(count, ch)
+	ApplyModAction(action, twitch.PrivateMessage{User: twitch.User{ID: targetID, Name: target}}, reason, ch)
+	return fmt.Sprintf("Strike %d for %s (%s).", count, target, action)
+}
+
+// StrikesCommand handles !strikes <user>, listing their active strikes.
+func StrikesCommand(options string, ch broadcaster) string {
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		return "Usage: !strikes <user>"
+	}
+	target := strings.TrimPrefix(fields[0], "@")
+	rows, err := ch.database.Query("SELECT reason, issuedby, created FROM strikes WHERE "+strikesFor+" ORDER BY created DESC;", strikeUserID(target, ch), target, SettingGetInt("strikes.decaydays", ch.database))
+	if err != nil {
+		handleSQLError(err)
+		return "I couldn't look up strikes due to a SQL error."
+	}
+	defer rows.Close()
+
+	var parts []string
+	for rows.Next() {
+		var (
+			reason, issuedBy string
+			created          time.Time
+		)
+		if err := rows.Scan(&reason, &issuedBy, &created); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s by %s on %s", reason, issuedBy, created.Format("2006-01-02")))
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("%s has no active strikes.", target)
+	}
+	result := fmt.Sprintf("%s has %d active strikes: %s", target, len(parts), strings.Join(parts, "; "))
+	return truncateMessage(result)
+}
@@ -0,0 +1,309 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+/* Shared Store */
+
+// sharedStore keeps every channel in the bot DB instead of creating a database each. Commands, users and
+// quotes go in shared tables keyed by channel_id. The feature tables still assume a channel to themselves,
+// so each channel gets a schema of its own for them, in the same database, built by the feature migrations only.
+// The schema is picked per connection, so a channel's feature tables still need a small pool of their own; only
+// the shared tables use the bot DB's.
+type sharedStore struct {
+	postgresStore
+}
+
+func sharedStoreOpen() (Store, error) {
+	s, err := postgresStoreOpen()
+	if err != nil {
+		return nil, err
+	}
+	return sharedStore{s}, nil
+}
+
+// featurePoolSize is the most connections one channel's feature schema may hold open.
+const featurePoolSize = 4
+
+// tenantSchema is where a channel's feature tables live. The prefix keeps a channel called public out of public.
+func tenantSchema(name string) string {
+	return "channel_" + name
+}
+
+// schemaPrepare creates the channel's feature schema if it's missing.
+func (s sharedStore) schemaPrepare(name string) error {
+	_, err := s.db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(tenantSchema(name)) + ";")
+	return err
+}
+
+// featuresConnect opens the bot DB with the channel's schema as the only one unqualified names resolve in,
+// so the feature code can't reach another channel's tables, or the shared ones.
+func (s sharedStore) featuresConnect(name string) (*sql.DB, error) {
+	database, err := dbConnect(s.endpoint, s.user, s.password, s.name, "postgres", url.Values{"search_path": {tenantSchema(name)}})
+	if err != nil {
+		return nil, err
+	}
+	// Every channel holds its own pool, so it's capped to keep the channels within the server's connection limit.
+	// Migrating holds one connection for its lock and another for each step, so the cap can't go below two.
+	database.SetMaxOpenConns(featurePoolSize)
+	database.SetMaxIdleConns(1)
+	return database, nil
+}
+
+func (s sharedStore) ChannelCreate(name string) error {
+	if !ValidChannelName(name) {
+		return errBadChannelName
+	}
+	if err := s.schemaPrepare(name); err != nil {
+		return err
+	}
+	features, err := s.featuresConnect(name)
+	if err != nil {
+		return err
+	}
+	defer features.Close()
+	// A new schema is migrated even when migrations are manual, as a new channel database is.
+	_, err = Migrate(features, "postgres/features", -1)
+	return err
+}
+
+func (s sharedStore) Channel(name string) (ChannelStore, error) {
+	if !ValidChannelName(name) {
+		return nil, errBadChannelName
+	}
+	id, err := s.BroadcasterID(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a broadcaster: %v", name, err)
+	}
+	features, err := s.featuresConnect(name)
+	if err != nil {
+		return nil, err
+	}
+	return sharedChannel{TenantRepository{s.db, id}, features, s, name}, nil
+}
+
+// sharedChannel is one channel's rows in the shared tables, plus its own schema for the feature tables.
+type sharedChannel struct {
+	TenantRepository
+	features *sql.DB
+	store    sharedStore
+	channel  string
+}
+
+func (c sharedChannel) DB() *sql.DB {
+	return c.features
+}
+
+// MigrationSets builds only the feature tables in the schema, since commands, users and quotes are in the shared ones.
+func (c sharedChannel) MigrationSets() []string {
+	return []string{"postgres/features"}
+}
+
+// Prepare creates the schema too, for channels that had a database of their own before DB_TENANCY=shared.
+func (c sharedChannel) Prepare() {
+	if err := c.store.schemaPrepare(c.channel); err != nil {
+		handleSQLError(err)
+		return
+	}
+	if err := MigrateOnConnect(c.features, "postgres/features", c.channel+"'s feature schema"); err != nil {
+		zap.S().Errorf("Couldn't migrate %v's feature schema: %v", c.channel, err)
+	}
+}
+
+/* Import */
+
+// tenantImport copies a channel's commands, users, quotes and feature tables from its own database into the
+// shared store. Rows already there are kept, so an interrupted import can simply be run again.
+func tenantImport(from, to ChannelStore) (string, error) {
+	comms, err := from.Commands()
+	if err != nil {
+		return "", err
+	}
+	added := 0
+	for _, comm := range comms {
+		if _, err := to.Command(comm.trigger); err == sql.ErrNoRows {
+			if err := to.CommandInsert(comm); err != nil {
+				return "", err
+			}
+			added++
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	users, err := from.Users()
+	if err != nil {
+		return "", err
+	}
+	for _, u := range users {
+		if err := to.UserAdd(u); err != nil {
+			return "", err
+		}
+	}
+
+	quotes, err := from.Quotes()
+	if err != nil {
+		return "", err
+	}
+	for _, q := range quotes {
+		if err := to.QuoteImport(q); err != nil {
+			return "", err
+		}
+	}
+
+	tables, err := copyFeatureTables(from.DB(), to.DB())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d of %d commands, %d users, %d quotes, %d feature tables", added, len(comms), len(users), len(quotes), tables), nil
+}
+
+// copyFeatureTables copies every table the repositories don't know about, row by row, keeping identity
+// values so references between the feature tables still line up.
+func copyFeatureTables(from, to *sql.DB) (int, error) {
+	tables, err := queryStrings(from, "SELECT c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'p') AND NOT c.relispartition AND c.relname NOT IN ('commands', 'channelusers', 'quotes', 'schema_version', 'feature_version') ORDER BY c.relname;")
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range tables {
+		if table == "chatlog" {
+			// Rows only go into a partitioned table when there's a partition for their day.
+			days, err := queryStrings(from, "SELECT DISTINCT to_char(sent, 'YYYY-MM-DD') FROM chatlog;")
+			if err != nil {
+				return 0, err
+			}
+			for _, day := range days {
+				if t, err := time.Parse("2006-01-02", day); err == nil {
+					chatLogPartition(t, to)
+				}
+			}
+		}
+		if err := copyTable(table, from, to); err != nil {
+			return 0, fmt.Errorf("copying %s: %v", table, err)
+		}
+	}
+	return len(tables), nil
+}
+
+func copyTable(table string, from, to *sql.DB) error {
+	quoted := pq.QuoteIdentifier(table)
+	rows, err := from.Query("SELECT * FROM " + quoted + ";")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = pq.QuoteIdentifier(column)
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) OVERRIDING SYSTEM VALUE VALUES (%s) ON CONFLICT DO NOTHING;", quoted, strings.Join(names, ", "), strings.Join(params, ", "))
+
+	return WithTx(to, func(tx *sql.Tx) error {
+		statement, err := tx.Prepare(insert)
+		if err != nil {
+			return err
+		}
+		defer statement.Close()
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(pointers...); err != nil {
+				return err
+			}
+			if _, err := statement.Exec(values...); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Identity columns carry on after the copied rows, not from 1.
+		identities, err := queryStrings(tx, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND is_identity = 'YES';", table)
+		if err != nil {
+			return err
+		}
+		for _, column := range identities {
+			_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence($1, $2), GREATEST((SELECT MAX(%s) FROM %s), 1));", pq.QuoteIdentifier(column), quoted), quoted, column)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TenantImportRun moves the named channels, or every broadcaster, from their own databases into the shared store.
+func TenantImportRun(names []string) error {
+	store, ok := STORE.(sharedStore)
+	if !ok {
+		return fmt.Errorf("importing needs DB_TENANCY=shared, to say where the channels go")
+	}
+	if err := MigrateOnConnect(store.DB(), store.MigrationSet(), "the bot DB"); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		var err error
+		if names, err = store.Broadcasters(); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, name := range names {
+		name = strings.ToLower(name)
+		summary, err := tenantImportOne(store, name)
+		if err != nil {
+			zap.S().Errorf("Couldn't import %v: %v", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %s\n", name, summary)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d channels failed; fix them and run the import again", failed, len(names))
+	}
+	return nil
+}
+
+func tenantImportOne(store sharedStore, name string) (string, error) {
+	// The source is the channel's own database, where it lived before DB_TENANCY=shared.
+	from, err := store.postgresStore.Channel(name)
+	if err != nil {
+		return "", err
+	}
+	defer from.DB().Close()
+	// Older channel databases may be missing tables the import reads, such as channelusers.
+	for _, set := range from.MigrationSets() {
+		if err := MigrateOnConnect(from.DB(), set, name); err != nil {
+			return "", err
+		}
+	}
+	if err := store.ChannelCreate(name); err != nil {
+		return "", err
+	}
+	to, err := store.Channel(name)
+	if err != nil {
+		return "", err
+	}
+	defer to.DB().Close()
+	return tenantImport(from, to)
+}
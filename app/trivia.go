@@ -0,0 +1,520 @@
+// Package gotwitchbot contains a complete Twitch.tv bot, including IRC connection.
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/gempir/go-twitch-irc/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// Question packs bigger than this are almost certainly a mistake.
+	triviaMaxPackBytes = 1 << 20
+	triviaMaxRounds    = 25
+)
+
+func init() {
+	settingDefaults["trivia.reward"] = "50"
+	settingDefaults["trivia.roundseconds"] = "30"
+	settingDefaults["trivia.season"] = "1"
+}
+
+type triviaQuestion struct {
+	category string
+	question string
+	answers  []string
+}
+
+type triviaGame struct {
+	current *triviaQuestion
+	answer  chan twitch.PrivateMessage
+	stop    chan struct{}
+	scores  map[string]int
+}
+
+var (
+	triviaMutex sync.Mutex
+	triviaGames = make(map[string]*triviaGame)
+	// triviaHTTP only connects to public addresses. The check runs on the address actually dialed, so a
+	// redirect, or a name that resolves somewhere internal, can't reach the VPC or the metadata endpoint.
+	triviaHTTP = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// No proxy, since a proxy would make the connection the check never sees.
+			Proxy:               nil,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: triviaDialControl}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("packs must be linked over https")
+			}
+			if len(via) >= 5 {
+				return errors.New("the pack link redirects too many times")
+			}
+			return nil
+		},
+	}
+)
+
+/* Trivia Tables */
+
+func triviaQuestions(category string, limit int, db *sql.DB) []triviaQuestion {
+	query := "SELECT category, question, answers FROM triviaquestions ORDER BY RANDOM() LIMIT $1;"
+	args := []interface{}{limit}
+	if category != "" {
+		query = "SELECT category, question, answers FROM triviaquestions WHERE LOWER(category) = LOWER($1) ORDER BY RANDOM() LIMIT $2;"
+		args = []interface{}{category, limit}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		handleSQLError(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var questions []triviaQuestion
+	for rows.Next() {
+		var (
+			q       triviaQuestion
+			answers string
+		)
+		if err := rows.Scan(&q.category, &q.question, &answers); err != nil {
+			handleSQLError(err)
+			continue
+		}
+		q.answers = strings.Split(answers, "|")
+		questions = append(questions, q)
+	}
+	return questions
+}
+
+// TriviaImport saves a question pack, skipping questions the bank already has.
+func TriviaImport(questions []triviaQuestion, db *sql.DB) (int, error) {
+	added := 0
+	err := WithTx(db, func(tx *sql.Tx) error {
+		for _, q := range questions {
+			res, err := tx.Exec("INSERT INTO triviaquestions (category, question, answers) VALUES ($1, $2, $3) ON CONFLICT (question) DO NOTHING;", q.category, q.question, strings.Join(q.answers, "|"))
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			added += int(n)
+		}
+		return nil
+	})
+	return added, err
+}
+
+func triviaAddScore(userID, userName string, season string, db *sql.DB) {
+	_, err := db.Exec("INSERT INTO triviascores (season, userid, username, score) VALUES ($1, $2, $3, 1) ON CONFLICT (season, userid) DO UPDATE SET score = triviascores.score + 1, username = EXCLUDED.username;", season, userID, userName)
+	if err != nil {
+		handleSQLError(err)
+	}
+}
+
+/* Question Packs */
+
+// parseTriviaPack reads a JSON array of {"category", "question", "answers"} objects,
+// or CSV rows of category,question,answer[,answer...].
+func parseTriviaPack(data []byte) ([]triviaQuestion, error) {
+	var questions []triviaQuestion
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var pack []struct {
+			Category string   `json:"category"`
+			Question string   `json:"question"`
+			Answer   string   `json:"answer"`
+			Answers  []string `json:"answers"`
+		}
+		if err := json.Unmarshal(data, &pack); err != nil {
+			return nil, err
+		}
+		for _, item := range pack {
+			answers := item.Answers
+			if item.Answer != "" {
+				answers = append(answers, item.Answer)
+			}
+			questions = append(questions, triviaQuestion{category: item.Category, question: item.Question, answers: answers})
+		}
+	} else {
+		reader := csv.NewReader(strings.NewReader(trimmed))
+		reader.FieldsPerRecord = -1
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if len(record) < 3 || strings.EqualFold(record[0], "category") {
+				continue
+			}
+			questions = append(questions, triviaQuestion{category: record[0], question: record[1], answers: record[2:]})
+		}
+	}
+
+	var valid []triviaQuestion
+	for _, q := range questions {
+		q.category = strings.ToLower(strings.TrimSpace(q.category))
+		q.question = strings.TrimSpace(q.question)
+		var answers []string
+		for _, answer := range q.answers {
+			answer = strings.TrimSpace(strings.ReplaceAll(answer, "|", "/"))
+			if answer != "" {
+				answers = append(answers, answer)
+			}
+		}
+		if q.question == "" || len(answers) == 0 {
+			continue
+		}
+		q.answers = answers
+		valid = append(valid, q)
+	}
+	if len(valid) == 0 {
+		return nil, errors.New("the pack has no usable questions")
+	}
+	return valid, nil
+}
+
+// cgnatRange is carrier-grade NAT space, which net.IP doesn't count as private but is just as internal.
+var _, cgnatRange, _ = net.ParseCIDR("100.64.0.0/10")
+
+// publicAddress reports whether ip is on the public internet.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip))
+}
+
+// triviaDialControl refuses to connect pack downloads anywhere but the public internet.
+func triviaDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%s isn't a public address", host)
+	}
+	return nil
+}
+
+// fetchTriviaPack downloads a pack over HTTPS from a public address, through triviaHTTP.
+func fetchTriviaPack(url string) ([]triviaQuestion, error) {
+	if !strings.HasPrefix(strings.ToLower(url), "https://") {
+		return nil, errors.New("packs must be linked over https")
+	}
+	resp, err := triviaHTTP.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the pack failed: %v", resp.Status)
+	}
+	return readTriviaPack(resp.Body)
+}
+
+// readTriviaPack reads a pack of at most triviaMaxPackBytes, from a download or a local file.
+func readTriviaPack(r io.Reader) ([]triviaQuestion, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, triviaMaxPackBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > triviaMaxPackBytes {
+		return nil, errors.New("the pack is too big")
+	}
+	return parseTriviaPack(data)
+}
+
+/* Answer Matching */
+
+func normalizeAnswer(answer string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(answer) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			b.WriteRune(r)
+		}
+	}
+	words := strings.Fields(b.String())
+	if len(words) > 1 && (words[0] == "the" || words[0] == "a" || words[0] == "an") {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// levenshtein is the edit distance between two strings, counted in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// triviaCorrect accepts answers within a typo or two of any accepted answer, scaled by length.
+func triviaCorrect(guess string, answers []string) bool {
+	guess = normalizeAnswer(guess)
+	if guess == "" {
+		return false
+	}
+	for _, answer := range answers {
+		answer = normalizeAnswer(answer)
+		allowed := len([]rune(answer)) / 5
+		if allowed > 3 {
+			allowed = 3
+		}
+		if levenshtein(guess, answer) <= allowed {
+			return true
+		}
+	}
+	return false
+}
+
+/* GoRoutines - Subprocesses */
+
+func triviaRun(game *triviaGame, questions []triviaQuestion, ch broadcaster) {
+	defer func() {
+		triviaMutex.Lock()
+		if triviaGames[ch.name] == game {
+			delete(triviaGames, ch.name)
+		}
+		triviaMutex.Unlock()
+	}()
+
+	roundTime := time.Duration(SettingGetInt("trivia.roundseconds", ch.database)) * time.Second
+	reward := int64(SettingGetInt("trivia.reward", ch.database))
+	season := SettingGet("trivia.season", ch.database)
+
+	for i := range questions {
+		q := questions[i]
+		triviaMutex.Lock()
+		// Drop a correct answer that raced the previous round's timer.
+		select {
+		case <-game.answer:
+		default:
+		}
+		game.current = &q
+		triviaMutex.Unlock()
+		SendChannelMessage(ch.name, fmt.Sprintf("Trivia %d/%d [%s]: %s", i+1, len(questions), q.category, q.question))
+
+		timer := time.NewTimer(roundTime)
+		select {
+		case <-game.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			SendChannelMessage(ch.name, fmt.Sprintf("Time's up! The answer was %s.", q.answers[0]))
+		case winner := <-game.answer:
+			timer.Stop()
+			triviaMutex.Lock()
+			game.scores[winner.User.Name]++
+			triviaMutex.Unlock()
+			triviaAddScore(winner.User.ID, winner.User.Name, season, ch.database)
+			if reward > 0 {
+				err := WithTx(ch.database, func(tx *sql.Tx) error {
+					_, err := PointsAdjust(tx, winner.User.ID, winner.User.Name, reward, "trivia")
+					return err
+				})
+				if err != nil {
+					handleSQLError(err)
+				}
+			}
+			won := fmt.Sprintf("%s got it! The answer was %s.", winner.User.Name, q.answers[0])
+			if reward > 0 {
+				won += fmt.Sprintf(" +%d %s", reward, SettingGet("points.name", ch.database))
+			}
+			SendChannelMessage(ch.name, won)
+		}
+
+		triviaMutex.Lock()
+		game.current = nil
+		triviaMutex.Unlock()
+		if i < len(questions)-1 {
+			select {
+			case <-game.stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+
+	triviaMutex.Lock()
+	best, leaders := 0, []string{}
+	for name, score := range game.scores {
+		if score > best {
+			best, leaders = score, []string{name}
+		} else if score == best {
+			leaders = append(leaders, name)
+		}
+	}
+	triviaMutex.Unlock()
+	if best == 0 {
+		SendChannelMessage(ch.name, "Trivia's over, nobody got one right this time!")
+	} else {
+		SendChannelMessage(ch.name, fmt.Sprintf("Trivia's over! Top score %d from %s.", best, strings.Join(leaders, ", ")))
+	}
+}
+
+/* Chat Hooks */
+
+// TriviaObserve checks chat messages against the current question.
+func TriviaObserve(message twitch.PrivateMessage, ch broadcaster) {
+	triviaMutex.Lock()
+	defer triviaMutex.Unlock()
+	game := triviaGames[ch.name]
+	if game == nil || game.current == nil {
+		return
+	}
+	if triviaCorrect(message.Message, game.current.answers) {
+		game.current = nil
+		game.answer <- message
+	}
+}
+
+/* Commands */
+
+// TriviaCommand handles !trivia start [category] [rounds], stop, top [season] and import <url>.
+func TriviaCommand(message twitch.PrivateMessage, options string, userPermissionLevel string, ch broadcaster) string {
+	fields := strings.Fields(options)
+	isMod := AuthorizeCommand(userPermissionLevel, message.User.Name, "m")
+	usage := "Usage: !trivia top [season], or for mods !trivia start [category] [rounds]|stop|import <url>"
+	if len(fields) == 0 {
+		return usage
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "top":
+		season := SettingGet("trivia.season", ch.database)
+		if len(fields) > 1 {
+			season = fields[1]
+		}
+		rows, err := ch.database.Query("SELECT username, score FROM triviascores WHERE season = $1 ORDER BY score DESC LIMIT 5;", season)
+		if err != nil {
+			handleSQLError(err)
+			return ""
+		}
+		defer rows.Close()
+		var ranking []string
+		for rows.Next() {
+			var (
+				name  string
+				score int
+			)
+			if err := rows.Scan(&name, &score); err == nil {
+				ranking = append(ranking, fmt.Sprintf("%d. %s (%d)", len(ranking)+1, name, score))
+			}
+		}
+		if len(ranking) == 0 {
+			return fmt.Sprintf("Nobody has scored in trivia season %s yet.", season)
+		}
+		return fmt.Sprintf("Trivia season %s: %s", season, strings.Join(ranking, ", "))
+	}
+
+	if !isMod {
+		return ""
+	}
+	switch strings.ToLower(fields[0]) {
+	case "start":
+		category, rounds := "", 5
+		for _, option := range fields[1:] {
+			if n, err := strconv.Atoi(option); err == nil {
+				rounds = n
+			} else {
+				category = option
+			}
+		}
+		if rounds < 1 || rounds > triviaMaxRounds {
+			return fmt.Sprintf("Trivia can run between 1 and %d rounds.", triviaMaxRounds)
+		}
+
+		triviaMutex.Lock()
+		defer triviaMutex.Unlock()
+		if triviaGames[ch.name] != nil {
+			return "There's already a trivia game running."
+		}
+
+		questions := triviaQuestions(category, rounds, ch.database)
+		if len(questions) < rounds && botDBPostgres() {
+			seen := make(map[string]bool)
+			for _, q := range questions {
+				seen[q.question] = true
+			}
+			for _, q := range triviaQuestions(category, rounds, BOTDB) {
+				if !seen[q.question] && len(questions) < rounds {
+					questions = append(questions, q)
+				}
+			}
+		}
+		if len(questions) == 0 {
+			return "I don't have any trivia questions for that category."
+		}
+		rand.Shuffle(len(questions), func(i, j int) { questions[i], questions[j] = questions[j], questions[i] })
+
+		game := &triviaGame{answer: make(chan twitch.PrivateMessage, 1), stop: make(chan struct{}), scores: make(map[string]int)}
+		triviaGames[ch.name] = game
+		go triviaRun(game, questions, ch)
+		return fmt.Sprintf("Trivia time! %d questions, first correct answer in chat wins each round.", len(questions))
+	case "stop":
+		triviaMutex.Lock()
+		defer triviaMutex.Unlock()
+		game := triviaGames[ch.name]
+		if game == nil {
+			return "There's no trivia game running."
+		}
+		close(game.stop)
+		delete(triviaGames, ch.name)
+		return "Trivia stopped."
+	case "import":
+		if len(fields) < 2 {
+			return "Usage: !trivia import <url to a JSON or CSV pack>"
+		}
+		questions, err := fetchTriviaPack(fields[1])
+		if err != nil {
+			zap.S().Errorf("Trivia import for %v failed: %v", ch.name, err)
+			return fmt.Sprintf("I couldn't import that pack: %v", err)
+		}
+		added, err := TriviaImport(questions, ch.database)
+		if err != nil {
+			handleSQLError(err)
+			return "I couldn't import that pack due to a SQL error."
+		}
+		return fmt.Sprintf("Imported %d new trivia questions.", added)
+	default:
+		return usage
+	}
+}
@@ -26,7 +26,9 @@ resource "aws_iam_user_policy" "bot-secrets-policy" {
               "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/db-name*",
               "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/db-endpoint*",
               "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/bot-username*",
-              "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/bot-oauth*"
+              "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/bot-oauth*",
+              "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/bot-client-id*",
+              "arn:aws:secretsmanager:ca-central-1:280028325900:secret:sandbox/twitch-chatbot/bot-client-secret*"
             ]
         }
     ]